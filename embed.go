@@ -0,0 +1,18 @@
+//go:build embed
+
+package main
+
+import (
+    "embed"
+    "io/fs"
+)
+
+// embeddedFiles are the contents of the embedded directory, built into the
+// binary by ./make.bash embed. -embedded serves them in place of -dir.
+//
+//go:embed embedded
+var embeddedFiles embed.FS
+
+func init() {
+    gEmbeddedFS, _ = fs.Sub(embeddedFiles, "embedded")
+}
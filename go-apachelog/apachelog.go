@@ -34,6 +34,11 @@ routing first. In a simple web application, for example, you might just use http
 http.Handler in an apachelog handler using NewHandler, create an http.Server with this handler, and you're
 good to go.
 
+To log one JSON object per request instead (handy for shipping logs to something like Elasticsearch), pass the
+JSON option: apachelog.NewHandler(mux, os.Stderr, apachelog.JSON()). For a different line layout, build an
+option from an Apache LogFormat-style string with Format, e.g. Format("%h %t \"%r\" %>s %b %D"), or use
+Format(CombinedLogFormat) for Apache's combined format.
+
 Example:
 
 		mux := http.NewServeMux()
@@ -48,11 +53,19 @@ Example:
 package apachelog
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
     "strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -60,76 +73,644 @@ import (
 // in seconds at the the end of the log line.
 const apacheFormatPattern = "%s:%s - - [%s] \"%s %s %s\" %d %d %0.4f\n"
 
+// The same format with the response time as a whole number of microseconds, like Apache's %D, which is what log
+// analyzers such as GoAccess expect.
+const apacheFormatPatternMicros = "%s:%s - - [%s] \"%s %s %s\" %d %d %d\n"
+
+// CombinedLogFormat is Apache's combined log format, for use with Format. It's what most log analyzers expect by
+// default.
+const CombinedLogFormat = "%h %l %u %t \"%r\" %>s %b \"%{Referer}i\" \"%{User-Agent}i\""
+
 // record is a wrapper around a ResponseWriter that carries other metadata needed to write a log line.
 type record struct {
 	http.ResponseWriter
 
 	ip                    string
+	host                  string // ip, or its hostname with ResolveHosts
     port                  string
 	time                  time.Time
 	method, uri, protocol string
+	header                http.Header
+	tls                   *tls.ConnectionState
+	logTLS                bool
+	logRequestID          bool
+	logSNI                bool
+	micros                bool
+	utc                   bool
 	status                int
+	wroteHeader           bool
 	responseBytes         int64
 	elapsedTime           time.Duration
 }
 
 // Log writes the record out as a single log line to out.
 func (r *record) Log(out io.Writer) {
-	timeFormatted := r.time.Format("02/Jan/2006 15:04:05")
-	fmt.Fprintf(out, apacheFormatPattern, r.ip, r.port, timeFormatted, r.method, r.uri, r.protocol, r.status,
-		r.responseBytes, r.elapsedTime.Seconds())
+	layout := "02/Jan/2006 15:04:05"
+	if r.utc {
+		// without an offset, a UTC time reads like local time
+		layout += " -0700"
+	}
+	timeFormatted := r.time.Format(layout)
+	var line string
+	if r.micros {
+		line = fmt.Sprintf(apacheFormatPatternMicros, r.host, r.port, timeFormatted, r.method, r.uri, r.protocol,
+			r.status, r.responseBytes, r.elapsedTime.Microseconds())
+	} else {
+		line = fmt.Sprintf(apacheFormatPattern, r.host, r.port, timeFormatted, r.method, r.uri, r.protocol, r.status,
+			r.responseBytes, r.elapsedTime.Seconds())
+	}
+	if extra := r.extraFields(); len(extra) > 0 {
+		line = strings.TrimSuffix(line, "\n") + " " + strings.Join(extra, " ") + "\n"
+	}
+	io.WriteString(out, line)
+}
+
+// extraFields returns the optional fields enabled for the record, which are appended to the common format line
+// and to lines laid out by Format.
+func (r *record) extraFields() (fields []string) {
+	if r.logTLS {
+		fields = append(fields, tlsVersionName(r.tls), tlsCipherName(r.tls))
+	}
+	if r.logRequestID {
+		fields = append(fields, r.requestID())
+	}
+	if r.logSNI {
+		fields = append(fields, tlsServerName(r.tls))
+	}
+	return
+}
+
+// StatusClientClosedRequest is logged, as nginx does, for requests whose client went away before any response was
+// sent. A client that goes away part of the way through the body is logged with the status that was sent and the
+// bytes written up to then.
+const StatusClientClosedRequest = 499
+
+// RequestIDHeader is the header the request ID logged by the LogRequestID option is taken from.
+const RequestIDHeader = "X-Request-ID"
+
+// requestID returns the request ID the handler sent in the RequestIDHeader response header, or "-" if none.
+func (r *record) requestID() string {
+	if id := r.Header().Get(RequestIDHeader); id != "" {
+		return id
+	}
+	return "-"
+}
+
+// tlsVersionNames maps TLS versions to the names mod_ssl logs for %{SSL_PROTOCOL}x.
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// tlsVersionName returns the name of the TLS version negotiated on a connection, or "-" if it didn't use TLS.
+func tlsVersionName(state *tls.ConnectionState) string {
+	if state == nil {
+		return "-"
+	}
+	if name, ok := tlsVersionNames[state.Version]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", state.Version)
+}
+
+// tlsCipherName returns the name of the cipher suite negotiated on a connection, or "-" if it didn't use TLS.
+func tlsCipherName(state *tls.ConnectionState) string {
+	if state == nil {
+		return "-"
+	}
+	return tls.CipherSuiteName(state.CipherSuite)
+}
+
+// tlsServerName returns the server name the client asked for with SNI, or "-" if it didn't use TLS or sent none.
+func tlsServerName(state *tls.ConnectionState) string {
+	if state == nil || state.ServerName == "" {
+		return "-"
+	}
+	return state.ServerName
+}
+
+// logFormat is a parsed LogFormat-style format string: a list of parts, each rendering either literal text or
+// one field of a record.
+type logFormat []func(r *record) string
+
+// formatDirectives maps the supported single-letter LogFormat directives to the record field they log.
+var formatDirectives = map[byte]func(r *record) string{
+	'h': func(r *record) string { return r.host },
+	'a': func(r *record) string { return r.ip },
+	// identd and authenticated users, which we never have
+	'l': func(r *record) string { return "-" },
+	'u': func(r *record) string { return "-" },
+	'p': func(r *record) string { return r.port },
+	't': func(r *record) string { return "[" + r.time.Format("02/Jan/2006:15:04:05 -0700") + "]" },
+	'r': func(r *record) string { return r.method + " " + r.uri + " " + r.protocol },
+	'm': func(r *record) string { return r.method },
+	'U': func(r *record) string { return strings.SplitN(r.uri, "?", 2)[0] },
+	'q': func(r *record) string {
+		if i := strings.Index(r.uri, "?"); i >= 0 {
+			return r.uri[i:]
+		}
+		return ""
+	},
+	'H': func(r *record) string { return r.protocol },
+	's': func(r *record) string { return strconv.Itoa(r.status) },
+	'b': func(r *record) string {
+		if r.responseBytes == 0 {
+			return "-"
+		}
+		return strconv.FormatInt(r.responseBytes, 10)
+	},
+	'B': func(r *record) string { return strconv.FormatInt(r.responseBytes, 10) },
+	'D': func(r *record) string { return strconv.FormatInt(r.elapsedTime.Microseconds(), 10) },
+	'T': func(r *record) string { return strconv.FormatInt(int64(r.elapsedTime/time.Second), 10) },
+}
+
+// parseFormat parses an Apache LogFormat-style string. Supported directives are %h, %a, %l and %u (always -),
+// %p, %t, %r, %m, %U, %q, %H, %s (or %>s), %b, %B, %D, %T, %{Header}i for a request header, %{Header}o for a response header,
+// %{SSL_PROTOCOL}x and %{SSL_CIPHER}x for the negotiated TLS version and cipher suite, %{SSL_TLS_SNI}x for the
+// server name sent with SNI, and %% for a literal
+// percent sign.
+func parseFormat(format string) (logFormat, error) {
+	var f logFormat
+	literal := func(s string) {
+		f = append(f, func(*record) string { return s })
+	}
+	// mod_ssl's %{...}x variables that we can fill in
+	sslVariables := map[string]func(r *record) string{
+		"SSL_PROTOCOL": func(r *record) string { return tlsVersionName(r.tls) },
+		"SSL_CIPHER":   func(r *record) string { return tlsCipherName(r.tls) },
+		"SSL_TLS_SNI":  func(r *record) string { return tlsServerName(r.tls) },
+	}
+	for len(format) > 0 {
+		i := strings.IndexByte(format, '%')
+		if i < 0 {
+			literal(format)
+			break
+		}
+		if i > 0 {
+			literal(format[:i])
+		}
+		format = format[i+1:]
+		// the > in %>s asks Apache for the final status, which is the only one we have
+		format = strings.TrimPrefix(format, ">")
+		switch {
+		case format == "":
+			return nil, errors.New("apachelog: format ends with an incomplete directive")
+		case format[0] == '%':
+			literal("%")
+			format = format[1:]
+		case format[0] == '{':
+			end := strings.Index(format, "}")
+			if end < 0 || end+1 >= len(format) {
+				return nil, fmt.Errorf("apachelog: unsupported directive %%%s", format)
+			}
+			name := format[1:end]
+			switch {
+			case format[end+1] == 'i':
+				f = append(f, func(r *record) string {
+					if v := r.header.Get(name); v != "" {
+						return v
+					}
+					return "-"
+				})
+			case format[end+1] == 'o':
+				f = append(f, func(r *record) string {
+					if v := r.Header().Get(name); v != "" {
+						return v
+					}
+					return "-"
+				})
+			case format[end+1] == 'x' && sslVariables[name] != nil:
+				f = append(f, sslVariables[name])
+			default:
+				return nil, fmt.Errorf("apachelog: unsupported directive %%%s", format[:end+2])
+			}
+			format = format[end+2:]
+		default:
+			directive, ok := formatDirectives[format[0]]
+			if !ok {
+				return nil, fmt.Errorf("apachelog: unsupported directive %%%c", format[0])
+			}
+			f = append(f, directive)
+			format = format[1:]
+		}
+	}
+	return f, nil
+}
+
+// LogFormat writes the record out as a single log line laid out by f to out, followed by any optional fields, as
+// for the common format.
+func (r *record) LogFormat(out io.Writer, f logFormat) {
+	var line strings.Builder
+	for _, part := range f {
+		line.WriteString(part(r))
+	}
+	for _, field := range r.extraFields() {
+		line.WriteByte(' ')
+		line.WriteString(field)
+	}
+	line.WriteByte('\n')
+	io.WriteString(out, line.String())
+}
+
+// jsonRecord is the shape of a record when logged as JSON.
+type jsonRecord struct {
+	IP         string  `json:"ip"`
+	Host       string  `json:"host,omitempty"`
+	Port       string  `json:"port"`
+	Time       string  `json:"time"`
+	Method     string  `json:"method"`
+	URI        string  `json:"uri"`
+	Protocol   string  `json:"protocol"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	ElapsedMs  float64 `json:"elapsed_ms"`
+	TLSVersion string  `json:"tls_version,omitempty"`
+	TLSCipher  string  `json:"tls_cipher,omitempty"`
+	RequestID  string  `json:"request_id,omitempty"`
+	ServerName string  `json:"server_name,omitempty"`
+}
+
+// LogJSON writes the record out as a single JSON object, followed by a newline, to out.
+func (r *record) LogJSON(out io.Writer) {
+	jr := jsonRecord{
+		IP:        r.ip,
+		Port:      r.port,
+		Time:      r.time.Format(time.RFC3339),
+		Method:    r.method,
+		URI:       r.uri,
+		Protocol:  r.protocol,
+		Status:    r.status,
+		Bytes:     r.responseBytes,
+		ElapsedMs: r.elapsedTime.Seconds() * 1000,
+	}
+	if r.logTLS {
+		jr.TLSVersion = tlsVersionName(r.tls)
+		jr.TLSCipher = tlsCipherName(r.tls)
+	}
+	if r.logRequestID {
+		jr.RequestID = r.requestID()
+	}
+	if r.host != r.ip {
+		jr.Host = r.host
+	}
+	if r.logSNI {
+		jr.ServerName = tlsServerName(r.tls)
+	}
+	line, err := json.Marshal(jr)
+	if err != nil {
+		return
+	}
+	out.Write(append(line, '\n'))
+}
+
+// LogSlow writes a warning that the request took longer than threshold to out, as a line of text or, if asJSON is
+// set, as a JSON object with level "warning".
+func (r *record) LogSlow(out io.Writer, threshold time.Duration, asJSON bool) {
+	if !asJSON {
+		fmt.Fprintf(out, "WARNING: slow request: %s %s took %s (threshold %s)\n", r.method, r.uri,
+			r.elapsedTime, threshold)
+		return
+	}
+	line, err := json.Marshal(struct {
+		Level       string  `json:"level"`
+		Message     string  `json:"message"`
+		Time        string  `json:"time"`
+		Method      string  `json:"method"`
+		URI         string  `json:"uri"`
+		ElapsedMs   float64 `json:"elapsed_ms"`
+		ThresholdMs float64 `json:"threshold_ms"`
+	}{"warning", "slow request", r.time.Format(time.RFC3339), r.method, r.uri,
+		r.elapsedTime.Seconds() * 1000, threshold.Seconds() * 1000})
+	if err != nil {
+		return
+	}
+	out.Write(append(line, '\n'))
 }
 
 // Write proxies to the underlying ResponseWriter.Write method while recording response size.
 func (r *record) Write(p []byte) (int, error) {
+	// a body without WriteHeader goes out as 200, whatever the handler sets later
+	r.wroteHeader = true
 	written, err := r.ResponseWriter.Write(p)
 	r.responseBytes += int64(written)
 	return written, err
 }
 
 // WriteHeader proxies to the underlying ResponseWriter.WriteHeader method while recording response status.
+// Only the first final status is recorded, since net/http ignores any later ones; 1xx informational
+// responses are passed through without being recorded.
 func (r *record) WriteHeader(status int) {
-	r.status = status
+	if !r.wroteHeader && status >= 200 {
+		r.status = status
+		r.wroteHeader = true
+	}
 	r.ResponseWriter.WriteHeader(status)
 }
 
+// Flush proxies to the underlying ResponseWriter's Flush method, if it has one, so streaming responses are not
+// held back by the wrapper.
+func (r *record) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack proxies to the underlying ResponseWriter's Hijack method. It returns an error if the underlying
+// ResponseWriter does not support hijacking.
+func (r *record) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("apachelog: underlying ResponseWriter does not implement http.Hijacker")
+	}
+	return h.Hijack()
+}
+
 // handler is an http.Handler that logs each response.
 type handler struct {
 	http.Handler
-	out io.Writer
+	out          io.Writer
+	json         bool
+	format       logFormat
+	logTLS       bool
+	logRequestID bool
+	logSNI       bool
+	hosts        *hostCache
+	skipPrefixes []string
+	micros       bool
+	utc          bool
+	noQuery      bool
+	slow         time.Duration
+	sample       uint64
+	sampled      atomic.Uint64 // successful requests seen, for sampling
+}
+
+// An Option changes how a handler created by NewHandler logs.
+type Option func(*handler)
+
+// JSON logs each request as a JSON object with the fields ip, port, time (RFC3339), method, uri, protocol,
+// status, bytes and elapsed_ms instead of as a line in the common log format.
+func JSON() Option {
+	return func(h *handler) {
+		h.json = true
+	}
 }
 
-// NewHandler creates a new http.Handler, given some underlying http.Handler to wrap and an output stream
-// (typically os.Stderr).
-func NewHandler(h http.Handler, out io.Writer) http.Handler {
-	return &handler{
+// LogTLS adds the negotiated TLS version and cipher suite to each log line, as two fields at the end of the line
+// ("- -" for plain HTTP requests) or as tls_version and tls_cipher in JSON.
+func LogTLS() Option {
+	return func(h *handler) {
+		h.logTLS = true
+	}
+}
+
+// LogRequestID adds the request ID to each log line, as a field at the end of the line or as request_id in JSON.
+// The ID is read from the RequestIDHeader response header once the wrapped handler is done, so the handler (or
+// middleware inside it) must set it.
+func LogRequestID() Option {
+	return func(h *handler) {
+		h.logRequestID = true
+	}
+}
+
+// LogServerName adds the server name the client asked for with SNI, which may differ from its Host header, to
+// each log line, as a field at the end of the line ("-" for plain HTTP or no SNI) or as server_name in JSON.
+func LogServerName() Option {
+	return func(h *handler) {
+		h.logSNI = true
+	}
+}
+
+// ResolveHosts logs the client's hostname, looked up with reverse DNS, in place of its IP address, falling back
+// to the IP when there's no name, like Apache's HostnameLookups On. %a still logs the IP, and JSON gains a host
+// field when a name is found. Names are cached, but each new client still waits for a lookup before its log line is written, so this
+// adds latency.
+func ResolveHosts() Option {
+	return func(h *handler) {
+		h.hosts = &hostCache{names: make(map[string]hostCacheEntry)}
+	}
+}
+
+// Microseconds writes the response time at the end of the common format line as a whole number of microseconds
+// (like Apache's %D) instead of as fractional seconds.
+func Microseconds() Option {
+	return func(h *handler) {
+		h.micros = true
+	}
+}
+
+// UTC logs times in UTC rather than the local time zone, so logs from machines in different zones line up. The
+// common format line then gains a +0000 offset after the time.
+func UTC() Option {
+	return func(h *handler) {
+		h.utc = true
+	}
+}
+
+// NoQuery leaves the query string out of the logged URI, wherever it appears, since query strings sometimes
+// carry tokens or personal data. The path is logged as the client sent it.
+func NoQuery() Option {
+	return func(h *handler) {
+		h.noQuery = true
+	}
+}
+
+// SkipPaths turns off logging for requests whose path starts with any of prefixes, such as health check or
+// metrics endpoints that are polled every few seconds.
+func SkipPaths(prefixes []string) Option {
+	return func(h *handler) {
+		h.skipPrefixes = append(h.skipPrefixes, prefixes...)
+	}
+}
+
+// SlowThreshold writes an extra WARNING line after the log line of any request that took longer than d, naming
+// its method, URI and response time, so slow responses stand out.
+func SlowThreshold(d time.Duration) Option {
+	return func(h *handler) {
+		h.slow = d
+	}
+}
+
+// Sample logs only one in every n successful (1xx, 2xx and 3xx) requests, to cut down the log volume of a busy
+// server. Errors and requests slower than the SlowThreshold are always logged. n <= 1 logs every request.
+func Sample(n int) Option {
+	return func(h *handler) {
+		if n > 1 {
+			h.sample = uint64(n)
+		}
+	}
+}
+
+// Format returns an option that lays out each log line according to an Apache LogFormat-style string (see
+// parseFormat for the supported directives). The format is parsed once, here; an empty format keeps the default
+// common log format.
+func Format(format string) (Option, error) {
+	if format == "" {
+		return func(*handler) {}, nil
+	}
+	f, err := parseFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	return func(h *handler) {
+		h.format = f
+	}, nil
+}
+
+// NewHandler creates a new http.Handler, given some underlying http.Handler to wrap, an output stream
+// (typically os.Stderr) and any options.
+func NewHandler(h http.Handler, out io.Writer, opts ...Option) http.Handler {
+	lh := &handler{
 		Handler: h,
 		out:     out,
 	}
+	for _, opt := range opts {
+		opt(lh)
+	}
+	return lh
 }
 
-// ServeHTTP delegates to the underlying handler's ServeHTTP method and writes one log line for every call.
+// ServeHTTP delegates to the underlying handler's ServeHTTP method and writes one log line for every call, except
+// for paths skipped with SkipPaths.
 func (h *handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	for _, prefix := range h.skipPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			h.Handler.ServeHTTP(rw, r)
+			return
+		}
+	}
+
 	record := &record{
 		ResponseWriter: rw,
 		ip:             getIP(r.RemoteAddr),
+		host:           getIP(r.RemoteAddr),
         port:           getPort(r),
 		time:           time.Time{},
 		method:         r.Method,
 		uri:            r.RequestURI,
 		protocol:       r.Proto,
+		header:         r.Header,
+		tls:            r.TLS,
+		logTLS:         h.logTLS,
+		logRequestID:   h.logRequestID,
+		logSNI:         h.logSNI,
+		micros:         h.micros,
+		utc:            h.utc,
 		status:         http.StatusOK,
 		elapsedTime:    time.Duration(0),
 	}
 
+	if h.noQuery {
+		record.uri, _, _ = strings.Cut(record.uri, "?")
+	}
+
 	startTime := time.Now()
+	defer func() {
+		// a panicking handler still gets a log line before net/http deals with the panic: as a 500 if nothing
+		// was sent, or with the status that was, as when ReverseProxy aborts a body with http.ErrAbortHandler
+		if err := recover(); err != nil {
+			if !record.wroteHeader {
+				record.status = http.StatusInternalServerError
+			}
+			h.log(record, startTime)
+			panic(err)
+		}
+	}()
 	h.Handler.ServeHTTP(record, r)
+	if !record.wroteHeader && errors.Is(r.Context().Err(), context.Canceled) {
+		// nothing was sent, so the 200 the record starts with would be a lie
+		record.status = StatusClientClosedRequest
+	}
+	h.log(record, startTime)
+}
+
+// log fills in the finish time and elapsed time of a record for a request started at startTime and writes it
+// out in the handler's format.
+func (h *handler) log(record *record, startTime time.Time) {
 	finishTime := time.Now()
 
 	record.time = finishTime
+	if record.utc {
+		record.time = finishTime.UTC()
+	}
 	record.elapsedTime = finishTime.Sub(startTime)
 
-	record.Log(h.out)
+	slow := h.slow > 0 && record.elapsedTime > h.slow
+	if h.sample > 0 && record.status < 400 && !slow && (h.sampled.Add(1)-1)%h.sample != 0 {
+		return
+	}
+	if h.hosts != nil {
+		record.host = h.hosts.lookup(record.ip)
+	}
+	switch {
+	case h.json:
+		record.LogJSON(h.out)
+	case h.format != nil:
+		record.LogFormat(h.out, h.format)
+	default:
+		record.Log(h.out)
+	}
+	if slow {
+		record.LogSlow(h.out, h.slow, h.json)
+	}
+}
+
+// hostCacheSize is the most hostnames a hostCache keeps, and hostCacheTTL how long it keeps each.
+const (
+	hostCacheSize = 4096
+	hostCacheTTL  = time.Hour
+)
+
+// hostCache remembers the results of reverse DNS lookups, including failed ones, by IP address.
+type hostCache struct {
+	mu    sync.Mutex
+	names map[string]hostCacheEntry
+}
+
+type hostCacheEntry struct {
+	name    string
+	expires time.Time
+}
+
+// lookup returns the hostname of ip, or ip itself if it has none or can't be looked up within a couple of
+// seconds. IPv6 addresses may come in brackets, as getIP gives them.
+func (c *hostCache) lookup(ip string) string {
+	bare := strings.TrimSuffix(strings.TrimPrefix(ip, "["), "]")
+	if net.ParseIP(bare) == nil {
+		return ip
+	}
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.names[ip]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.name
+	}
+	name := ip
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if names, err := net.DefaultResolver.LookupAddr(ctx, bare); err == nil && len(names) > 0 {
+		name = strings.TrimSuffix(names[0], ".")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.names) >= hostCacheSize {
+		// make room by dropping expired names, or failing that an arbitrary one
+		for k, e := range c.names {
+			if now.After(e.expires) {
+				delete(c.names, k)
+			}
+		}
+		for k := range c.names {
+			if len(c.names) < hostCacheSize {
+				break
+			}
+			delete(c.names, k)
+		}
+	}
+	c.names[ip] = hostCacheEntry{name: name, expires: now.Add(hostCacheTTL)}
+	return name
 }
 
 // A best-effort attempt at getting the IP from http.Request.RemoteAddr. For a Go server, they typically look
@@ -138,6 +719,10 @@ func (h *handler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 // [::1]:44092
 // I think this is standard for IPv4 and IPv6 addresses.
 func getIP(remoteAddr string) string {
+	// requests over a Unix domain socket come from an unnamed peer
+	if remoteAddr == "" || remoteAddr == "@" {
+		return "-"
+	}
 	host, _, err := net.SplitHostPort(remoteAddr)
 	if err != nil {
 		return remoteAddr
@@ -151,15 +736,27 @@ func getIP(remoteAddr string) string {
 	return host
 }
 
+// getPort returns the port the request was addressed to, taken from the Host header. Hosts may be names, IPv4
+// addresses or bracketed IPv6 addresses, each with or without a port:
+// example.com:8080
+// [::1]:8080
+// [::1]
+// When no port is given, the default port for the scheme is returned.
 func getPort(r *http.Request) string {
-    _, port, err := net.SplitHostPort(r.Host)
-    if err != nil {
-        // default ports (80/443) do not show up in r.Host
-        if r.TLS == nil {
-            return "80"
-        } else {
-            return "443"
-        }
-    }
-    return port
+	host := r.Host
+	// a bracketed IPv6 address only carries a port after the closing bracket; anything else with colons in
+	// it is an address without a port
+	if i := strings.LastIndex(host, "]"); i >= 0 {
+		host = host[i+1:]
+	} else if strings.Count(host, ":") > 1 {
+		host = ""
+	}
+	if i := strings.LastIndex(host, ":"); i >= 0 && i < len(host)-1 {
+		return host[i+1:]
+	}
+	// default ports (80/443) do not show up in r.Host
+	if r.TLS == nil {
+		return "80"
+	}
+	return "443"
 }
@@ -0,0 +1,404 @@
+package apachelog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeWriter is a ResponseWriter that can be flushed and hijacked, and
+// remembers whether it was.
+type fakeWriter struct {
+	*httptest.ResponseRecorder
+	flushed  bool
+	hijacked bool
+}
+
+func (w *fakeWriter) Flush() {
+	w.flushed = true
+}
+
+func (w *fakeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func TestRecordFlushAndHijack(t *testing.T) {
+	fw := &fakeWriter{ResponseRecorder: httptest.NewRecorder()}
+	var canFlush, canHijack bool
+	var hijackErr error
+	h := NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, ok := w.(http.Flusher)
+		canFlush = ok
+		if ok {
+			f.Flush()
+		}
+		hj, ok := w.(http.Hijacker)
+		canHijack = ok
+		if ok {
+			_, _, hijackErr = hj.Hijack()
+		}
+	}), &bytes.Buffer{})
+	h.ServeHTTP(fw, httptest.NewRequest("GET", "/", nil))
+	if !canFlush || !fw.flushed {
+		t.Errorf("Flush wasn't passed through (Flusher %v, flushed %v)", canFlush, fw.flushed)
+	}
+	if !canHijack || !fw.hijacked || hijackErr != nil {
+		t.Errorf("Hijack wasn't passed through (Hijacker %v, hijacked %v, err %v)", canHijack, fw.hijacked, hijackErr)
+	}
+}
+
+func TestRecordHijackUnsupported(t *testing.T) {
+	var err error
+	h := NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _, err = w.(http.Hijacker).Hijack()
+	}), &bytes.Buffer{})
+	// a ResponseRecorder can be flushed but not hijacked
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err == nil {
+		t.Error("Hijack on a writer that can't be hijacked didn't fail")
+	}
+}
+
+func TestGetPort(t *testing.T) {
+	tests := []struct {
+		host   string
+		useTLS bool
+		want   string
+	}{
+		{"[::1]:8080", false, "8080"},
+		{"[::1]", false, "80"},
+		{"[::1]", true, "443"},
+		{"::1", false, "80"},
+		{"example.com:443", false, "443"},
+		{"example.com", false, "80"},
+		{"example.com", true, "443"},
+		{"example.com:", false, "80"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = tt.host
+		if !tt.useTLS {
+			r.TLS = nil
+		} else if r.TLS == nil {
+			r.TLS = &tls.ConnectionState{}
+		}
+		if got := getPort(r); got != tt.want {
+			t.Errorf("getPort with Host %q (TLS %v) = %q, want %q", tt.host, tt.useTLS, got, tt.want)
+		}
+	}
+}
+
+// logLine serves r with handler wrapped in a NewHandler with opts and returns
+// the log line written, without its newline.
+func logLine(t *testing.T, handler http.Handler, r *http.Request, opts ...Option) string {
+	t.Helper()
+	var out bytes.Buffer
+	NewHandler(handler, &out, opts...).ServeHTTP(httptest.NewRecorder(), r)
+	return strings.TrimSuffix(out.String(), "\n")
+}
+
+func TestFormat(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Served-By", "test")
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, "hello")
+	})
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"%h %l %u", "192.0.2.1 - -"},
+		{"%m %U %q %H", "GET /a/b ?x=1 HTTP/1.1"},
+		{`"%r"`, `"GET /a/b?x=1 HTTP/1.1"`},
+		{"%s %>s %b %B", "404 404 5 5"},
+		{"%p", "8080"},
+		{"%{User-Agent}i %{X-Served-By}o %{Missing}i", "tester test -"},
+		{"100%%", "100%"},
+	}
+	for _, tt := range tests {
+		opt, err := Format(tt.format)
+		if err != nil {
+			t.Errorf("Format(%q): %s", tt.format, err)
+			continue
+		}
+		r := httptest.NewRequest("GET", "/a/b?x=1", nil)
+		r.Host = "example.com:8080"
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Header.Set("User-Agent", "tester")
+		if got := logLine(t, handler, r, opt); got != tt.want {
+			t.Errorf("Format(%q) logged %q, want %q", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestFormatTimes(t *testing.T) {
+	opt, err := Format("%t %D %T")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := logLine(t, http.NotFoundHandler(), httptest.NewRequest("GET", "/", nil), opt)
+	if !regexp.MustCompile(`^\[\d\d/\w{3}/\d{4}:\d\d:\d\d:\d\d [-+]\d{4}\] \d+ 0$`).MatchString(got) {
+		t.Errorf("logged %q", got)
+	}
+}
+
+func TestFormatEmptyIsCommon(t *testing.T) {
+	opt, err := Format("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := logLine(t, http.NotFoundHandler(), httptest.NewRequest("GET", "/x", nil), opt)
+	if !strings.Contains(got, `"GET /x HTTP/1.1" 404 19 `) {
+		t.Errorf("logged %q, want the common format", got)
+	}
+}
+
+func TestFormatInvalid(t *testing.T) {
+	for _, format := range []string{"%", "%Z", "%{User-Agent"} {
+		if _, err := Format(format); err == nil {
+			t.Errorf("Format(%q) didn't fail", format)
+		}
+	}
+}
+
+// content is a handler serving 1000 bytes with http.ServeContent, which
+// handles Range and conditional requests.
+var content = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	http.ServeContent(w, r, "content.txt", modTime, strings.NewReader(strings.Repeat("x", 1000)))
+})
+
+func TestRangeRequest(t *testing.T) {
+	opt, err := Format("%s %B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/content.txt", nil)
+	r.Header.Set("Range", "bytes=0-99")
+	NewHandler(content, &out, opt).ServeHTTP(w, r)
+	if w.Code != http.StatusPartialContent {
+		t.Errorf("got status %d, want 206", w.Code)
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 0-99/1000" {
+		t.Errorf("got Content-Range %q, want %q", got, "bytes 0-99/1000")
+	}
+	if w.Body.Len() != 100 {
+		t.Errorf("got %d bytes of body, want 100", w.Body.Len())
+	}
+	if got := out.String(); got != "206 100\n" {
+		t.Errorf("logged %q, want %q", got, "206 100\n")
+	}
+}
+
+func TestPanicIsLogged(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    string
+	}{
+		{"before the header", func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		}, "500 0\n"},
+		{"after the body started", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "partial")
+			panic(http.ErrAbortHandler)
+		}, "200 7\n"},
+	}
+	opt, err := Format("%s %B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: the panic wasn't passed on", tt.name)
+				}
+			}()
+			NewHandler(tt.handler, &out, opt).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}()
+		if got := out.String(); got != tt.want {
+			t.Errorf("%s: logged %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	opt, err := Format("%s %B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/content.txt", nil)
+	r.Header.Set("If-Modified-Since", time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC).Format(http.TimeFormat))
+	NewHandler(content, &out, opt).ServeHTTP(w, r)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("got status %d, want 304", w.Code)
+	}
+	if got := out.String(); got != "304 0\n" {
+		t.Errorf("logged %q, want %q", got, "304 0\n")
+	}
+}
+
+func TestStatusAndBytes(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    string
+	}{
+		{"body without WriteHeader", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "hello")
+		}, "200 5"},
+		{"WriteHeader then body", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, "made")
+		}, "201 4"},
+		{"WriteHeader without body", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}, "204 0"},
+	}
+	opt, err := Format("%s %B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		if got := logLine(t, tt.handler, httptest.NewRequest("GET", "/", nil), opt); got != tt.want {
+			t.Errorf("%s: logged %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	next := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first\n")
+		w.(http.Flusher).Flush()
+		<-next
+		io.WriteString(w, "second\n")
+	})
+	var out bytes.Buffer
+	srv := httptest.NewServer(NewHandler(handler, &out))
+	defer srv.Close()
+	defer close(next)
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := bufio.NewReader(resp.Body)
+	// the handler holds back the second chunk until the first arrives, so
+	// this only returns if Flush got through the log handler
+	done := make(chan string)
+	go func() {
+		line, _ := body.ReadString('\n')
+		done <- line
+	}()
+	select {
+	case line := <-done:
+		if line != "first\n" {
+			t.Fatalf("got first chunk %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first chunk wasn't flushed to the client")
+	}
+	next <- struct{}{}
+	if line, _ := body.ReadString('\n'); line != "second\n" {
+		t.Errorf("got second chunk %q", line)
+	}
+}
+
+func TestClientClosedRequest(t *testing.T) {
+	opt, err := Format("%s %B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	waiter := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	if got := logLine(t, waiter, r, opt); got != "499 0" {
+		t.Errorf("gone client: logged %q, want %q", got, "499 0")
+	}
+	// a response sent before the client went keeps its status
+	if got := logLine(t, http.NotFoundHandler(), r, opt); !strings.HasPrefix(got, "404 ") {
+		t.Errorf("404 to a gone client: logged %q", got)
+	}
+}
+
+func TestMultiWriter(t *testing.T) {
+	var stdout, file bytes.Buffer
+	h := NewHandler(content, io.MultiWriter(&stdout, &file))
+	for _, path := range []string{"/a", "/b"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	if strings.Count(stdout.String(), "\n") != 2 || stdout.String() != file.String() {
+		t.Errorf("the writers got different logs:\n%s\nand\n%s", stdout.String(), file.String())
+	}
+}
+
+func TestLogServerName(t *testing.T) {
+	var out bytes.Buffer
+	srv := httptest.NewUnstartedServer(NewHandler(http.NotFoundHandler(), &out, LogServerName()))
+	srv.StartTLS()
+	client := srv.Client()
+	// the test certificate is good for example.com
+	client.Transport.(*http.Transport).TLSClientConfig.ServerName = "example.com"
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	srv.Close()
+	if got := strings.TrimSuffix(out.String(), "\n"); !strings.HasSuffix(got, " example.com") {
+		t.Errorf("logged %q, want the server name at the end", got)
+	}
+
+	got := logLine(t, http.NotFoundHandler(), httptest.NewRequest("GET", "/", nil), LogServerName())
+	if !strings.HasSuffix(got, " -") {
+		t.Errorf("without TLS: logged %q, want - at the end", got)
+	}
+}
+
+func TestLookupIPv6(t *testing.T) {
+	c := &hostCache{names: make(map[string]hostCacheEntry)}
+	// failed lookups are cached too, so either way [::1] is in the cache if
+	// it was taken for an address
+	got := c.lookup("[::1]")
+	if got == "" {
+		t.Fatal("lookup gave nothing for [::1]")
+	}
+	if _, ok := c.names["[::1]"]; !ok {
+		t.Errorf("[::1] wasn't looked up; got %q", got)
+	}
+}
+
+func TestFormatExtraFields(t *testing.T) {
+	opt, err := Format("%s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(RequestIDHeader, "abc")
+	})
+	got := logLine(t, handler, httptest.NewRequest("GET", "/", nil), opt, LogTLS(), LogRequestID(), LogServerName())
+	if want := "200 - - abc -"; got != want {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
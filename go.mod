@@ -0,0 +1,14 @@
+module github.com/ryanchapman/go-simple-web-server
+
+go 1.26.0
+
+require (
+	github.com/andybalholm/brotli v1.2.5
+	golang.org/x/crypto v0.57.0
+	golang.org/x/time v0.16.0
+)
+
+require (
+	golang.org/x/net v0.58.0 // indirect
+	golang.org/x/text v0.42.0 // indirect
+)
@@ -22,6 +22,22 @@ function build ()
     return $?
 }
 
+# build with the files in the embedded directory built in, for -embedded
+function build_embed ()
+{
+    make_version
+    go build -tags embed simple_web_server.go version.go embed.go
+    return $?
+}
+
+# run the tests of the main package and of webserver and go-apachelog
+function run_tests ()
+{
+    make_version
+    go test ./...
+    return $?
+}
+
 function build_failed ()
 {
     echo "TRAVIS_TEST_RESULT=$TRAVIS_TEST_RESULT"
@@ -47,6 +63,12 @@ case $1 in
   "build_failed")
     build_failed
     ;;
+  "embed")
+    build_embed
+    ;;
+  "test")
+    run_tests
+    ;;
   *)
     build
     ;;
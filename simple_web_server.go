@@ -30,128 +30,713 @@
 package main
 
 import (
-    apachelog "./go-apachelog"
-    "crypto/rand"
-    "crypto/rsa"
-    "crypto/x509"
-    "crypto/x509/pkix"
-    "encoding/pem"
+    "github.com/ryanchapman/go-simple-web-server/webserver"
+    "context"
+    "crypto/tls"
+    "errors"
     "flag"
     "fmt"
+    "io"
+    "io/fs"
     "log"
-    "math/big"
     "net"
     "net/http"
+    "net/url"
     "os"
+    "os/exec"
     "os/signal"
     "path/filepath"
+    "runtime"
+    "runtime/pprof"
     "strconv"
     "strings"
-    "sync"
+    "syscall"
     "time"
 )
 
 const VERSION = "1.0"
 
-var randuint uint32
-var randmu sync.Mutex
 var gHTTPPortsCSV  string
 var gHTTPSPortsCSV string
 var gHTTPPorts     []string
 var gHTTPSPorts    []string
-var gCertFile      string = tempFilename("cert.pem")
-var gKeyFile       string = tempFilename("key.pem")
-
-func tempFilename(prefix string) (fileName string) {
-    dir := os.Getenv("TMPDIR")
-    if dir == "" {
-        dir = os.Getenv("TMP")
-        if dir == "" {
-            dir = os.Getenv("TEMP")  // windows
-            if dir == "" {
-                dir = "/tmp"
-            }
+var gListen        string
+var gUnixSocket    string
+var gConfigFile    string
+var gCommandLine   map[string]bool
+var gDir           string
+var gEmbedded      bool
+var gEmbeddedFS    fs.FS // set by embed.go in binaries built with ./make.bash embed
+var gVHosts        string
+var gFollowSymlinks bool
+var gSPA           bool
+var gCacheMaxAge   int
+var gETag          bool
+var gShowVersion   bool
+var gUpload        bool
+var gForceDownload bool
+var gDownloadExts  string
+var gRootRedirect  string
+var gProxies       string
+var gBannerFile    string
+var gReadOnly      bool
+var gIndex         string
+var gErrorPages    string
+var gListingTemplate string
+var gMIMETypes     string
+var gCharset       string
+var gCORS          string
+var gCSP           string
+var gHSTS          string
+var gFrameOptions  string
+var gServerHeader  string
+var gLogFormat     string
+var gLogTemplate   string
+var gLogTLS        bool
+var gLogSNI        bool
+var gLogResolve    bool
+var gRequestID     bool
+var gLogSkip       string
+var gLogMicros     bool
+var gLogUTC        bool
+var gLogNoQuery    bool
+var gLogSample     int
+var gDump          bool
+var gSyslog        string
+var gLogFile       string
+var gLogBuffer     int
+var gLogOut        io.Writer = os.Stdout
+var gAdminShutdown string
+var gSignals       = make(chan os.Signal, 1)
+var gPrefix        string
+var gNoHTTP2       bool
+var gDebugTLS      bool
+var gDisableHTTP   bool
+var gDisableHTTPS  bool
+var gDryRun        bool
+var gCPUProfile    string
+var gMemProfile    string
+var gPProf         bool
+var gPProfAddr     string
+var gHealth        bool
+var gMaxConns      int
+var gKeepAlive     time.Duration
+var gReusePort     bool
+var gListenBacklog int
+var gAutoPort      int
+var gOpen          bool
+var gSelfTest      bool
+var gShutdownTimeout time.Duration
+var gHandlerTimeout time.Duration
+var gSlowThreshold time.Duration
+var gMaxHeaderBytes int
+var gMaxBodyBytes  int64
+var gMaxFileSize   int64
+var gRateLimit     float64
+var gTrustedProxies string
+var gAllow         string
+var gDeny          string
+var gPrecompressed bool
+var gGzip          bool
+var gGzipLevel     int
+var gGzipMin       int
+var gBrotli        bool
+var gCertFile      string
+var gKeyFile       string
+var gCertOrg       string
+var gCertDays      int
+var gACMEDomains   string
+var gACMECache     string
+
+// systemdListeners returns the listening sockets handed to us by systemd socket
+// activation (see sd_listen_fds(3)), along with the name each was given via
+// FileDescriptorName= in the .socket unit. Sockets named "https" are served with
+// TLS. Returns nothing when the process was not socket activated.
+func systemdListeners() (listeners []net.Listener, names []string) {
+    pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+    if err != nil || pid != os.Getpid() {
+        return
+    }
+    nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+    if err != nil || nfds <= 0 {
+        return
+    }
+    fdNames := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+    // don't pass the sockets on to any children
+    os.Unsetenv("LISTEN_PID")
+    os.Unsetenv("LISTEN_FDS")
+    os.Unsetenv("LISTEN_FDNAMES")
+
+    // inherited descriptors start at SD_LISTEN_FDS_START (3)
+    for i := 0; i < nfds; i++ {
+        name := ""
+        if i < len(fdNames) {
+            name = fdNames[i]
         }
+        f := os.NewFile(uintptr(3+i), name)
+        ln, err := net.FileListener(f)
+        f.Close()
+        if err != nil {
+            log.Fatalf("failed to use inherited socket (fd %d): %s", 3+i, err)
+        }
+        listeners = append(listeners, ln)
+        names = append(names, name)
     }
-    // http://golang.org/src/pkg/io/ioutil/tempfile.go
-    nconflict := 0
-    for i := 0; i < 10000; i++ {
-        fileName = filepath.Join(dir, prefix+nextSuffix())
-        f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
-        if os.IsExist(err) {
-            if nconflict++; nconflict > 10 {
-                randuint = reseed()
-            }
+    return
+}
+
+// loadConfigFile reads options from a file of key=value lines, where each key is
+// the name of a command line flag (e.g. "p=80,8080"). Blank lines and lines
+// starting with # are ignored. Flags given on the command line take precedence
+// over values from the file. It returns the names of the flags it set.
+func loadConfigFile(path string) (applied map[string]bool, err error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, fmt.Errorf("failed to read config file %s: %s", path, err)
+    }
+    applied = make(map[string]bool)
+    for i, line := range strings.Split(string(data), "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" || strings.HasPrefix(line, "#") {
             continue
         }
-        f.Close()
-        break
+        kv := strings.SplitN(line, "=", 2)
+        if len(kv) != 2 {
+            return nil, fmt.Errorf("%s:%d: expected key=value, got %q", path, i+1, line)
+        }
+        key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+        if key == "config" || flag.Lookup(key) == nil {
+            return nil, fmt.Errorf("%s:%d: unknown option %q", path, i+1, key)
+        }
+        if gCommandLine[key] {
+            continue
+        }
+        if err := flag.Set(key, value); err != nil {
+            return nil, fmt.Errorf("%s:%d: invalid value for %s: %s", path, i+1, key, err)
+        }
+        applied[key] = true
     }
-    return 
+    return applied, nil
 }
 
-// http://golang.org/src/pkg/io/ioutil/tempfile.go
-func nextSuffix() string {
-    randmu.Lock()
-    r := randuint
-    if r == 0 {
-        r = reseed()
+// portsFromEnv takes -p and -sp from the HTTP_PORTS and HTTPS_PORTS
+// environment variables unless given says they were set explicitly, on the
+// command line or in the config file, so the order of precedence is
+// flag > environment > default.
+func portsFromEnv(given map[string]bool) {
+    if ports := os.Getenv("HTTP_PORTS"); ports != "" && !given["p"] {
+        gHTTPPortsCSV = ports
+    }
+    if ports := os.Getenv("HTTPS_PORTS"); ports != "" && !given["sp"] {
+        gHTTPSPortsCSV = ports
     }
-    r = r*1664525 + 1013904223 // constants from Numerical Recipes
-    randuint = r
-    randmu.Unlock()
-    return strconv.Itoa(int(1e9 + r%1e9))[1:]
 }
 
-// http://golang.org/src/pkg/io/ioutil/tempfile.go
-func reseed() uint32 {
-    return uint32(time.Now().UnixNano() + int64(os.Getpid()))
+// loadOptions applies the config file, if any, and the environment on top of
+// the command line flags. Flags not on the command line are first reset to
+// their defaults, so options dropped from the file go back to the default
+// when it is loaded again.
+func loadOptions() error {
+    flag.VisitAll(func(f *flag.Flag) {
+        if !gCommandLine[f.Name] {
+            flag.Set(f.Name, f.DefValue)
+        }
+    })
+    given := make(map[string]bool)
+    for name := range gCommandLine {
+        given[name] = true
+    }
+    if gConfigFile != "" {
+        applied, err := loadConfigFile(gConfigFile)
+        if err != nil {
+            return err
+        }
+        for name := range applied {
+            given[name] = true
+        }
+    }
+    portsFromEnv(given)
+    return nil
+}
+
+// restartOnlyFlags are the options that shape the listeners rather than the
+// handler, so a reload can't apply them.
+var restartOnlyFlags = map[string]bool{
+    "p": true, "sp": true, "listen": true, "unix": true, "disable-http": true, "disable-https": true,
+    "max-conns": true, "max-header-bytes": true, "keepalive": true, "reuseport": true, "auto-port": true,
+    "no-http2": true, "debug-tls": true, "acme-domains": true, "acme-cache": true, "pprof-addr": true,
+    "healthz": true, "cpuprofile": true, "memprofile": true, "syslog": true, "logfile": true,
+    "access-log-buffer": true, "listen-backlog": true,
+}
+
+// flagValues returns the current value of every flag, by name.
+func flagValues() map[string]string {
+    values := make(map[string]string)
+    flag.VisitAll(func(f *flag.Flag) {
+        values[f.Name] = f.Value.String()
+    })
+    return values
 }
 
-func generateSelfSignedCert() () {
-    // from http://golang.org/src/pkg/crypto/tls/generate_cert.go
-    priv, err := rsa.GenerateKey(rand.Reader, 1024)
+// reload re-reads the config file and applies it to server, logging which
+// options changed. Options that only take effect on a restart are logged as
+// such. If anything is wrong with the new options, the old ones stay.
+func reload(server *webserver.Server) {
+    log.Printf("reloading configuration")
+    before := flagValues()
+    err := loadOptions()
+    var config webserver.Config
+    if err == nil {
+        config, err = newConfig()
+    }
+    if err == nil {
+        err = server.Reload(config)
+    }
     if err != nil {
-        log.Fatalf("failed to generate private key: %s", err)
+        for name, value := range before {
+            flag.Set(name, value)
+        }
+        log.Printf("reload failed, keeping the current configuration: %s", err)
         return
     }
-    template := x509.Certificate{
-        SerialNumber: new(big.Int).SetInt64(0),
-        Subject: pkix.Name{
-            Organization: []string{"Acme Co"},
-        },
-        NotBefore:             time.Now(),
-        NotAfter:              time.Now().Add(365*24*time.Hour),
-        KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-        ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-        BasicConstraintsValid: true,
-        IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
-        DNSNames:              []string{"localhost"},
-    }
-    derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+    after := flagValues()
+    changed := 0
+    flag.VisitAll(func(f *flag.Flag) {
+        if before[f.Name] == after[f.Name] {
+            return
+        }
+        changed++
+        if restartOnlyFlags[f.Name] {
+            log.Printf("  %s: %q -> %q (takes effect on restart)", f.Name, before[f.Name], after[f.Name])
+        } else {
+            log.Printf("  %s: %q -> %q", f.Name, before[f.Name], after[f.Name])
+        }
+    })
+    if changed == 0 {
+        log.Printf("reloaded configuration; no options changed")
+    } else {
+        log.Printf("reloaded configuration; %d options changed", changed)
+    }
+}
+
+// maxPorts caps how many ports a single port list may expand to, so a typo in
+// a range doesn't start thousands of listeners.
+const maxPorts = 1024
+
+// parsePort converts s to a port number, reporting whether it is in 1..65535.
+func parsePort(s string) (int, bool) {
+    port, err := strconv.Atoi(strings.TrimSpace(s))
+    return port, err == nil && port >= 1 && port <= 65535
+}
+
+// parsePorts splits a comma separated list of ports, expanding inclusive ranges
+// such as 8000-8010, checking that each is a number in 1..65535 and dropping
+// duplicates. An empty list means no ports.
+func parsePorts(csv string) (ports []string, err error) {
+    if strings.TrimSpace(csv) == "" {
+        return nil, nil
+    }
+    seen := make(map[int]bool)
+    for _, field := range strings.Split(csv, ",") {
+        field = strings.TrimSpace(field)
+        if field == "" {
+            return nil, fmt.Errorf("invalid port list %q: empty port", csv)
+        }
+        first, last := field, field
+        if i := strings.Index(field, "-"); i >= 0 {
+            first, last = field[:i], field[i+1:]
+        }
+        start, ok := parsePort(first)
+        if !ok {
+            return nil, fmt.Errorf("invalid port %q: must be a number between 1 and 65535", first)
+        }
+        end, ok := parsePort(last)
+        if !ok {
+            return nil, fmt.Errorf("invalid port %q: must be a number between 1 and 65535", last)
+        }
+        if start > end {
+            return nil, fmt.Errorf("invalid port range %q: start is greater than end", field)
+        }
+        for port := start; port <= end; port++ {
+            if seen[port] {
+                continue
+            }
+            if len(ports) == maxPorts {
+                return nil, fmt.Errorf("invalid port list %q: more than %d ports", csv, maxPorts)
+            }
+            seen[port] = true
+            ports = append(ports, strconv.Itoa(port))
+        }
+    }
+    return ports, nil
+}
+
+// shutdownRequest is the os.Signal sent to gSignals when a shutdown is asked
+// for over HTTP.
+type shutdownRequest struct{}
+
+func (shutdownRequest) String() string {
+    return "shutdown requested at " + webserver.ShutdownPath
+}
+
+func (shutdownRequest) Signal() {}
+
+// requestShutdown starts a graceful shutdown as if the process had received
+// SIGTERM.
+func requestShutdown() {
+    select {
+    case gSignals <- shutdownRequest{}:
+    default:
+        // a shutdown is already on its way
+    }
+}
+
+// startProfiling starts writing a CPU profile to gCPUProfile, if set. The
+// returned func stops it and writes a heap profile to gMemProfile, if set; it
+// must run before the process exits or the profiles are left incomplete.
+func startProfiling() (stop func()) {
+    var cpuFile *os.File
+    if gCPUProfile != "" {
+        f, err := os.Create(gCPUProfile)
+        if err != nil {
+            log.Fatalf("failed to create CPU profile: %s", err)
+        }
+        if err := pprof.StartCPUProfile(f); err != nil {
+            log.Fatalf("failed to start CPU profile: %s", err)
+        }
+        cpuFile = f
+    }
+    return func() {
+        if cpuFile != nil {
+            pprof.StopCPUProfile()
+            if err := cpuFile.Close(); err != nil {
+                log.Printf("failed to write CPU profile: %s", err)
+            }
+        }
+        if gMemProfile != "" {
+            f, err := os.Create(gMemProfile)
+            if err != nil {
+                log.Printf("failed to create memory profile: %s", err)
+                return
+            }
+            // up-to-date statistics on what is still in use
+            runtime.GC()
+            if err := pprof.WriteHeapProfile(f); err != nil {
+                log.Printf("failed to write memory profile: %s", err)
+            }
+            if err := f.Close(); err != nil {
+                log.Printf("failed to write memory profile: %s", err)
+            }
+        }
+    }
+}
+
+// openBrowser opens url in the default browser, using the platform's opener.
+// If the opener isn't installed, it only logs a warning.
+func openBrowser(url string) {
+    var name string
+    var args []string
+    switch runtime.GOOS {
+    case "darwin":
+        name = "open"
+    case "windows":
+        name, args = "rundll32", []string{"url.dll,FileProtocolHandler"}
+    default:
+        name = "xdg-open"
+    }
+    opener, err := exec.LookPath(name)
     if err != nil {
-        log.Fatalf("Failed to create certificate: %s", err)
+        log.Printf("warning: can't open %s in a browser: %s", url, err)
         return
     }
-    certOut, err := os.Create(gCertFile)
-    if err != nil {
-        log.Fatalf("failed to open %s for writing: %s", gCertFile, err)
+    if err := exec.Command(opener, append(args, url)...).Start(); err != nil {
+        log.Printf("warning: can't open %s in a browser: %s", url, err)
+    }
+}
+
+// selfTest fetches / from each of urls, and over the Unix socket at
+// unixSocket if it's set, logging how each went. Any HTTP response counts as
+// success, since all it has to show is that something is serving. The
+// self-signed certificate is accepted. It returns how many failed.
+func selfTest(urls []string, unixSocket string) (failed int) {
+    client := &http.Client{
+        Timeout: 5 * time.Second,
+        Transport: &http.Transport{
+            TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+        },
+        // a redirect is a response too
+        CheckRedirect: func(*http.Request, []*http.Request) error {
+            return http.ErrUseLastResponse
+        },
+    }
+    check := func(client *http.Client, name, u string) {
+        resp, err := client.Get(u)
+        if err != nil {
+            log.Printf("self-test: %s: %s", name, err)
+            failed++
+            return
+        }
+        resp.Body.Close()
+        log.Printf("self-test: %s: %s", name, resp.Status)
+    }
+    for _, u := range urls {
+        check(client, u, u)
+    }
+    if unixSocket != "" {
+        unixClient := *client
+        unixClient.Transport = &http.Transport{
+            DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+                var d net.Dialer
+                return d.DialContext(ctx, "unix", unixSocket)
+            },
+        }
+        check(&unixClient, "unix:"+unixSocket, "http://localhost/")
+    }
+    return
+}
+
+// parseListen splits a comma separated list of URLs such as
+// http://:8080,https://127.0.0.1:8443 into the addresses to serve on, keeping
+// their order. A URL without a port gets the scheme's default port.
+func parseListen(csv string) (addrs []webserver.Addr, err error) {
+    for _, field := range strings.Split(csv, ",") {
+        field = strings.TrimSpace(field)
+        u, err := url.Parse(field)
+        if err != nil {
+            return nil, fmt.Errorf("invalid listen address %q: %s", field, err)
+        }
+        if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+            return nil, fmt.Errorf("invalid listen address %q: expected scheme://host:port", field)
+        }
+        l := webserver.Addr{Host: u.Hostname(), Port: u.Port()}
+        switch u.Scheme {
+        case "http":
+            if l.Port == "" {
+                l.Port = "80"
+            }
+        case "https":
+            l.TLS = true
+            if l.Port == "" {
+                l.Port = "443"
+            }
+        default:
+            return nil, fmt.Errorf("invalid listen address %q: scheme must be http or https", field)
+        }
+        if _, ok := parsePort(l.Port); !ok {
+            return nil, fmt.Errorf("invalid port %q in listen address %q: must be a number between 1 and 65535", l.Port, field)
+        }
+        addrs = append(addrs, l)
+    }
+    return addrs, nil
+}
+
+// splitList splits a comma separated list, trimming space around each item.
+// An empty list gives no items.
+func splitList(csv string) (items []string) {
+    if csv == "" {
         return
     }
-    pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
-    certOut.Close()
+    for _, item := range strings.Split(csv, ",") {
+        items = append(items, strings.TrimSpace(item))
+    }
+    return
+}
 
-    keyOut, err := os.OpenFile(gKeyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+// newConfig builds the server configuration from the flags.
+func newConfig() (config webserver.Config, err error) {
+    if gCertDays <= 0 {
+        return config, fmt.Errorf("invalid -cert-days %d: must be positive", gCertDays)
+    }
+    if (gCertFile == "") != (gKeyFile == "") {
+        return config, fmt.Errorf("-cert and -key must be given together")
+    }
+    if gCertFile != "" && gACMEDomains != "" {
+        return config, fmt.Errorf("-cert can't be used with -acme-domains")
+    }
+    switch gLogFormat {
+    case "common", "combined":
+    case "json":
+        if gLogTemplate != "" {
+            return config, fmt.Errorf("-log-template can't be used with -log-format=json")
+        }
+    default:
+        return config, fmt.Errorf("invalid -log-format %q: expected common, combined or json", gLogFormat)
+    }
+    if gLogMicros && (gLogFormat != "common" || gLogTemplate != "") {
+        return config, fmt.Errorf("-log-micros only works with -log-format=common and no -log-template; use %%D in a template")
+    }
+    if gRateLimit < 0 {
+        return config, fmt.Errorf("invalid -rate-limit %g: must not be negative", gRateLimit)
+    }
+
+    gHTTPPorts, err = parsePorts(gHTTPPortsCSV)
+    if err != nil {
+        return
+    }
+    gHTTPSPorts, err = parsePorts(gHTTPSPortsCSV)
     if err != nil {
-        log.Print("failed to open %s for writing:", gKeyFile, err)
         return
     }
-    pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
-    keyOut.Close()
+    if gDisableHTTP {
+        gHTTPPorts = nil
+    }
+    if gDisableHTTPS {
+        gHTTPSPorts = nil
+    }
+    var addrs []webserver.Addr
+    if gListen != "" {
+        listen, err := parseListen(gListen)
+        if err != nil {
+            return config, err
+        }
+        for _, l := range listen {
+            if (l.TLS && !gDisableHTTPS) || (!l.TLS && !gDisableHTTP) {
+                addrs = append(addrs, l)
+            }
+        }
+    } else {
+        for _, port := range gHTTPPorts {
+            addrs = append(addrs, webserver.Addr{Port: port})
+        }
+        for _, port := range gHTTPSPorts {
+            addrs = append(addrs, webserver.Addr{Port: port, TLS: true})
+        }
+    }
+
+    vhosts := make(map[string]string)
+    if gVHosts != "" {
+        for _, pair := range strings.Split(gVHosts, ",") {
+            kv := strings.SplitN(pair, "=", 2)
+            if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+                return config, fmt.Errorf("invalid -vhost entry %q: expected host=dir", pair)
+            }
+            vhosts[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+        }
+    }
+    mimeTypes := make(map[string]string)
+    for _, pair := range splitList(gMIMETypes) {
+        kv := strings.SplitN(pair, "=", 2)
+        if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+            return config, fmt.Errorf("invalid -mime-types entry %q: expected ext=type", pair)
+        }
+        mimeTypes[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+    }
+    keepAlive := gKeepAlive
+    if keepAlive == 0 {
+        // 0 means off here, but Go's default in webserver.Config
+        keepAlive = -1
+    }
+    errorPages := make(map[int]string)
+    for _, pair := range splitList(gErrorPages) {
+        kv := strings.SplitN(pair, "=", 2)
+        code, err := strconv.Atoi(strings.TrimSpace(kv[0]))
+        if len(kv) != 2 || err != nil || code < 400 || code > 599 || strings.TrimSpace(kv[1]) == "" {
+            return config, fmt.Errorf("invalid -error-pages entry %q: expected code=file with a 4xx or 5xx code", pair)
+        }
+        errorPages[code] = strings.TrimSpace(kv[1])
+    }
+    proxies := make(map[string]string)
+    for _, pair := range splitList(gProxies) {
+        kv := strings.SplitN(pair, "=", 2)
+        if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+            return config, fmt.Errorf("invalid -proxy entry %q: expected prefix=url", pair)
+        }
+        proxies[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+    }
+    var dumpOut io.Writer
+    if gDump {
+        dumpOut = os.Stderr
+    }
+    var downloads []string
+    if gForceDownload {
+        downloads = splitList(gDownloadExts)
+        if len(downloads) == 0 {
+            downloads = []string{"*"}
+        }
+    }
+    var files fs.FS
+    if gEmbedded {
+        if gEmbeddedFS == nil {
+            return config, fmt.Errorf("-embedded: this binary has no files built in; build it with ./make.bash embed")
+        }
+        files = gEmbeddedFS
+    }
+    config = webserver.Config{
+        Root:            gDir,
+        FS:              files,
+        VHosts:          vhosts,
+        Prefix:          gPrefix,
+        Proxies:         proxies,
+        RootRedirect:    gRootRedirect,
+        BannerFile:      gBannerFile,
+        FollowSymlinks:  gFollowSymlinks,
+        SPA:             gSPA,
+        CacheMaxAge:     gCacheMaxAge,
+        ETag:            gETag,
+        Upload:          gUpload,
+        ReadOnly:        gReadOnly,
+        Index:           splitList(gIndex),
+        ErrorPages:      errorPages,
+        ListingTemplate: gListingTemplate,
+        MIMETypes:       mimeTypes,
+        Charset:         gCharset,
+        CORSOrigins:     splitList(gCORS),
+        CSP:             gCSP,
+        HSTS:            gHSTS,
+        FrameOptions:    gFrameOptions,
+        ServerHeader:    gServerHeader,
+        MaxBodyBytes:    gMaxBodyBytes,
+        MaxFileSize:     gMaxFileSize,
+        Downloads:       downloads,
+        TrustedProxies:  splitList(gTrustedProxies),
+        Allow:           splitList(gAllow),
+        Deny:            splitList(gDeny),
+        RateLimit:       gRateLimit,
+        Precompressed:   gPrecompressed,
+        Gzip:            gGzip,
+        GzipLevel:       gGzipLevel,
+        CompressMin:     gGzipMin,
+        Brotli:          gBrotli,
+        Timeout:         gHandlerTimeout,
+        LogFormat:       gLogFormat,
+        LogTemplate:     gLogTemplate,
+        LogTLS:          gLogTLS,
+        LogSNI:          gLogSNI,
+        LogResolve:      gLogResolve,
+        RequestID:       gRequestID,
+        LogSkip:         splitList(gLogSkip),
+        LogMicros:       gLogMicros,
+        LogUTC:          gLogUTC,
+        LogNoQuery:      gLogNoQuery,
+        LogSample:       gLogSample,
+        SlowThreshold:   gSlowThreshold,
+        LogOut:          gLogOut,
+        DumpOut:         dumpOut,
+        PProf:           gPProf && gPProfAddr == "",
+        ShutdownToken:   gAdminShutdown,
+        OnShutdown:      requestShutdown,
+        Addrs:           addrs,
+        MaxConns:        gMaxConns,
+        MaxHeaderBytes:  gMaxHeaderBytes,
+        KeepAlive:       keepAlive,
+        ReusePort:       gReusePort,
+        ListenBacklog:   gListenBacklog,
+        AutoPort:        gAutoPort,
+        NoHTTP2:         gNoHTTP2,
+        DebugTLS:        gDebugTLS,
+        CertFile:        gCertFile,
+        KeyFile:         gKeyFile,
+        CertOrg:         gCertOrg,
+        CertDays:        gCertDays,
+        ACMEDomains:     splitList(gACMEDomains),
+        ACMECache:       gACMECache,
+        UnixSocket:      gUnixSocket,
+        PProfAddr:       gPProfAddr,
+        Health:          gHealth,
+    }
     return
 }
 
-
 func versionString() (v string) {
     buildNum := strings.ToUpper(strconv.FormatInt(BUILDTIMESTAMP, 36))
     buildDate := time.Unix(BUILDTIMESTAMP, 0).Format(time.UnixDate)
@@ -166,77 +751,478 @@ func init() {
         fmt.Fprintf(os.Stderr, "Optional\n")
         fmt.Fprintf(os.Stderr, "  -p=PORTS     HTTP ports to listen on, separared by commas. Defaults to 80\n")
         fmt.Fprintf(os.Stderr, "  -sp=PORTS    HTTPS (SSL) ports to listen on, separared by commas. Defaults to 443\n")
+        fmt.Fprintf(os.Stderr, "               Port lists may include inclusive ranges, e.g. 8000-8010\n")
+        fmt.Fprintf(os.Stderr, "               When -p or -sp isn't given, the HTTP_PORTS or HTTPS_PORTS\n")
+        fmt.Fprintf(os.Stderr, "               environment variable is used before falling back to the default\n")
+        fmt.Fprintf(os.Stderr, "               An empty list, e.g. -p \"\", means no ports of that kind\n")
+        fmt.Fprintf(os.Stderr, "  -disable-http\n")
+        fmt.Fprintf(os.Stderr, "               Don't serve plain HTTP at all, whatever -p or -listen say\n")
+        fmt.Fprintf(os.Stderr, "  -disable-https\n")
+        fmt.Fprintf(os.Stderr, "               Don't serve HTTPS at all, whatever -sp or -listen say\n")
+        fmt.Fprintf(os.Stderr, "  -dir=DIR     Directory to serve. Defaults to the current directory. If DIR is\n")
+        fmt.Fprintf(os.Stderr, "               a file, that file alone is served at / and other paths are 404\n")
+        fmt.Fprintf(os.Stderr, "  -embedded    Serve the files built into the binary instead of -dir. Build with\n")
+        fmt.Fprintf(os.Stderr, "               ./make.bash embed to bundle the embedded directory\n")
+        fmt.Fprintf(os.Stderr, "  -vhost=HOST=DIR,...\n")
+        fmt.Fprintf(os.Stderr, "               Serve DIR to requests for HOST instead of -dir (virtual hosts)\n")
+        fmt.Fprintf(os.Stderr, "  -follow-symlinks\n")
+        fmt.Fprintf(os.Stderr, "               Serve symlinks that point outside the directory. By default they\n")
+        fmt.Fprintf(os.Stderr, "               get 403 Forbidden\n")
+        fmt.Fprintf(os.Stderr, "  -listen=URLS Addresses to listen on as URLs separated by commas, mixing HTTP and\n")
+        fmt.Fprintf(os.Stderr, "               HTTPS, e.g. http://:8080,https://127.0.0.1:8443. Overrides -p and -sp\n")
+        fmt.Fprintf(os.Stderr, "  -unix=PATH   Also serve plain HTTP on a Unix domain socket at PATH, e.g. behind\n")
+        fmt.Fprintf(os.Stderr, "               nginx. A stale socket left at PATH is removed first\n")
+        fmt.Fprintf(os.Stderr, "  -spa         Serve /index.html for paths that don't exist and have no file\n")
+        fmt.Fprintf(os.Stderr, "               extension, for single-page apps with client-side routing\n")
+        fmt.Fprintf(os.Stderr, "  -cache-max-age=SECONDS\n")
+        fmt.Fprintf(os.Stderr, "               Send Cache-Control: public, max-age=SECONDS with files. Off by default\n")
+        fmt.Fprintf(os.Stderr, "  -etag        Send a strong ETag (from file size and mtime) with files. Off by default\n")
+        fmt.Fprintf(os.Stderr, "  -config=FILE Read options from FILE, one key=value per line, where key is a\n")
+        fmt.Fprintf(os.Stderr, "               flag name without the dash (e.g. p=80,8080). Flags given on the\n")
+        fmt.Fprintf(os.Stderr, "               command line override values from the file. On SIGHUP the file is\n")
+        fmt.Fprintf(os.Stderr, "               read again and applied to new requests, except for the options\n")
+        fmt.Fprintf(os.Stderr, "               that set up the listeners, which need a restart\n")
+        fmt.Fprintf(os.Stderr, "  -prefix=PATH Serve the directory under PATH (e.g. /files/) instead of /\n")
+        fmt.Fprintf(os.Stderr, "  -proxy=PREFIX=URL,...\n")
+        fmt.Fprintf(os.Stderr, "               Pass requests under PREFIX on to the backend at URL, path and all,\n")
+        fmt.Fprintf(os.Stderr, "               e.g. /api=http://localhost:3000\n")
+        fmt.Fprintf(os.Stderr, "  -root-redirect=PATH\n")
+        fmt.Fprintf(os.Stderr, "               Redirect requests for / to PATH (e.g. /docs/index.html) with a 302\n")
+        fmt.Fprintf(os.Stderr, "  -banner-file=FILE\n")
+        fmt.Fprintf(os.Stderr, "               Serve FILE as the landing page at / (or the -prefix), even if there is\n")
+        fmt.Fprintf(os.Stderr, "               an index.html. Other paths are served as usual\n")
+        fmt.Fprintf(os.Stderr, "  -upload      Accept PUT requests, storing the body at the request path\n")
+        fmt.Fprintf(os.Stderr, "  -force-download\n")
+        fmt.Fprintf(os.Stderr, "               Send files with Content-Disposition: attachment, so browsers save\n")
+        fmt.Fprintf(os.Stderr, "               them instead of showing them\n")
+        fmt.Fprintf(os.Stderr, "  -download-exts=EXTS\n")
+        fmt.Fprintf(os.Stderr, "               Limit -force-download to files with these extensions, separated by\n")
+        fmt.Fprintf(os.Stderr, "               commas, e.g. zip,iso,pdf\n")
+        fmt.Fprintf(os.Stderr, "  -read-only   Answer 405 Method Not Allowed to methods other than GET and HEAD\n")
+        fmt.Fprintf(os.Stderr, "               (and PUT with -upload). On by default; -read-only=false turns it off\n")
+        fmt.Fprintf(os.Stderr, "  -index=NAMES Index file names to look for in directories, separated by commas\n")
+        fmt.Fprintf(os.Stderr, "               and tried in order, e.g. index.htm,default.html. Directories with\n")
+        fmt.Fprintf(os.Stderr, "               none of them fall back to index.html and then to a listing\n")
+        fmt.Fprintf(os.Stderr, "  -error-pages=CODE=FILE,...\n")
+        fmt.Fprintf(os.Stderr, "               HTML files to send as the body of error responses, by status code,\n")
+        fmt.Fprintf(os.Stderr, "               e.g. 404=404.html,500=oops.html\n")
+        fmt.Fprintf(os.Stderr, "  -listing-template=FILE\n")
+        fmt.Fprintf(os.Stderr, "               html/template file to render directory listings with. It is given\n")
+        fmt.Fprintf(os.Stderr, "               .Path and .Entries, each with .Name, .Size, .ModTime and .IsDir\n")
+        fmt.Fprintf(os.Stderr, "  -mime-types=EXT=TYPE,...\n")
+        fmt.Fprintf(os.Stderr, "               Content-Types for file extensions the built-in table gets wrong or\n")
+        fmt.Fprintf(os.Stderr, "               lacks, e.g. webmanifest=application/manifest+json. .wasm is always\n")
+        fmt.Fprintf(os.Stderr, "               served as application/wasm\n")
+        fmt.Fprintf(os.Stderr, "  -charset=CHARSET\n")
+        fmt.Fprintf(os.Stderr, "               Add \"; charset=CHARSET\" to text, JSON and JavaScript Content-Types\n")
+        fmt.Fprintf(os.Stderr, "               that lack one. Defaults to utf-8; -charset= turns it off\n")
+        fmt.Fprintf(os.Stderr, "  -cors=ORIGINS\n")
+        fmt.Fprintf(os.Stderr, "               Allow cross-origin requests from ORIGINS, separated by commas,\n")
+        fmt.Fprintf(os.Stderr, "               or * for any origin\n")
+        fmt.Fprintf(os.Stderr, "  -csp=POLICY  Send Content-Security-Policy: POLICY, e.g. \"default-src 'self'\"\n")
+        fmt.Fprintf(os.Stderr, "  -hsts=VALUE  Send Strict-Transport-Security: VALUE on HTTPS responses, e.g.\n")
+        fmt.Fprintf(os.Stderr, "               \"max-age=31536000; includeSubDomains\"\n")
+        fmt.Fprintf(os.Stderr, "  -frame-options=VALUE\n")
+        fmt.Fprintf(os.Stderr, "               Send X-Frame-Options: VALUE, e.g. DENY or SAMEORIGIN\n")
+        fmt.Fprintf(os.Stderr, "  -server-header=VALUE\n")
+        fmt.Fprintf(os.Stderr, "               Send Server: VALUE with every response, or with -server-header=-\n")
+        fmt.Fprintf(os.Stderr, "               make sure none is sent, not even one from a -proxy backend\n")
+        fmt.Fprintf(os.Stderr, "  -log-format=FORMAT\n")
+        fmt.Fprintf(os.Stderr, "               Shape of the access log: common (the default, with the response time\n")
+        fmt.Fprintf(os.Stderr, "               at the end), Apache's combined, or json for one object per request\n")
+        fmt.Fprintf(os.Stderr, "  -log-template=FORMAT\n")
+        fmt.Fprintf(os.Stderr, "               Lay out access log lines with an Apache LogFormat-style string,\n")
+        fmt.Fprintf(os.Stderr, "               e.g. '%%h %%t \"%%r\" %%>s %%b %%D'. Supports %%h %%a %%p %%t %%r %%m %%U %%q %%H\n")
+        fmt.Fprintf(os.Stderr, "               %%s %%b %%B %%D %%T %%{Header}i and %%%%. Overrides -log-format\n")
+        fmt.Fprintf(os.Stderr, "  -log-tls     Add the TLS version and cipher suite to each access log line\n")
+        fmt.Fprintf(os.Stderr, "  -log-sni     Add the server name HTTPS clients asked for with SNI, which may\n")
+        fmt.Fprintf(os.Stderr, "               differ from their Host header, to each access log line\n")
+        fmt.Fprintf(os.Stderr, "  -log-micros  Log response times as whole microseconds (like Apache's %%D, for\n")
+        fmt.Fprintf(os.Stderr, "               GoAccess) instead of fractional seconds. Common format only\n")
+        fmt.Fprintf(os.Stderr, "  -log-utc     Log times in UTC, with a +0000 offset, instead of local time\n")
+        fmt.Fprintf(os.Stderr, "  -log-resolve Log each client's hostname, looked up with reverse DNS, instead of its\n")
+        fmt.Fprintf(os.Stderr, "               IP, like Apache's HostnameLookups On. Names are cached, but lookups\n")
+        fmt.Fprintf(os.Stderr, "               for new clients add latency, so this is off by default\n")
+        fmt.Fprintf(os.Stderr, "  -log-no-query\n")
+        fmt.Fprintf(os.Stderr, "               Log only the path of each request, leaving out the query string,\n")
+        fmt.Fprintf(os.Stderr, "               which may carry tokens\n")
+        fmt.Fprintf(os.Stderr, "  -dump        Write each request's line and headers, and the response's status and\n")
+        fmt.Fprintf(os.Stderr, "               headers, to stderr for debugging. Separate from the access log\n")
+        fmt.Fprintf(os.Stderr, "  -log-sample=N\n")
+        fmt.Fprintf(os.Stderr, "               Log only one in N successful requests, to cut the log volume of a\n")
+        fmt.Fprintf(os.Stderr, "               busy site. Errors (4xx and 5xx) and slow requests are always logged\n")
+        fmt.Fprintf(os.Stderr, "  -syslog=ADDR Send the access log to syslog instead of stdout, one message per\n")
+        fmt.Fprintf(os.Stderr, "               request. ADDR is local for the local daemon, or host:port (UDP),\n")
+        fmt.Fprintf(os.Stderr, "               udp://host:port or tcp://host:port for a remote one. Not on Windows\n")
+        fmt.Fprintf(os.Stderr, "  -logfile=FILE\n")
+        fmt.Fprintf(os.Stderr, "               Also append the access log to FILE, as well as stdout (or syslog)\n")
+        fmt.Fprintf(os.Stderr, "  -access-log-buffer=BYTES\n")
+        fmt.Fprintf(os.Stderr, "               Buffer up to BYTES of the access log and write it out every second\n")
+        fmt.Fprintf(os.Stderr, "               (and on shutdown), for fewer system calls on busy sites. 0 (the\n")
+        fmt.Fprintf(os.Stderr, "               default) writes each line at once. Not with -syslog\n")
+        fmt.Fprintf(os.Stderr, "  -log-skip=PREFIXES\n")
+        fmt.Fprintf(os.Stderr, "               Don't log requests for paths starting with PREFIXES, separated by\n")
+        fmt.Fprintf(os.Stderr, "               commas, e.g. /healthz,/metrics\n")
+        fmt.Fprintf(os.Stderr, "  -request-id  Give each request an ID (or keep the one in its X-Request-ID header),\n")
+        fmt.Fprintf(os.Stderr, "               send it back in X-Request-ID and add it to the access log\n")
+        fmt.Fprintf(os.Stderr, "  -max-conns=N Serve at most N connections at once, across all ports. Further\n")
+        fmt.Fprintf(os.Stderr, "               connections wait to be accepted. 0 (the default) means no limit\n")
+        fmt.Fprintf(os.Stderr, "               Connections that send no request within 30s, or sit idle between\n")
+        fmt.Fprintf(os.Stderr, "               requests for 2m, are closed to free their slot\n")
+        fmt.Fprintf(os.Stderr, "  -keepalive=DURATION\n")
+        fmt.Fprintf(os.Stderr, "               TCP keep-alive period for connections, to notice peers that went\n")
+        fmt.Fprintf(os.Stderr, "               away behind NAT or a load balancer. 0 turns keep-alive off.\n")
+        fmt.Fprintf(os.Stderr, "               Defaults to 15s\n")
+        fmt.Fprintf(os.Stderr, "  -auto-port=N If a port is already in use, try up to N ports after it and log the\n")
+        fmt.Fprintf(os.Stderr, "               one that was used. 0 (the default) fails instead\n")
+        fmt.Fprintf(os.Stderr, "  -reuseport   Bind with SO_REUSEPORT, so several instances can serve the same\n")
+        fmt.Fprintf(os.Stderr, "               ports and share the load, or overlap during a restart. Linux and\n")
+        fmt.Fprintf(os.Stderr, "               BSDs (including macOS) only\n")
+        fmt.Fprintf(os.Stderr, "  -listen-backlog=N\n")
+        fmt.Fprintf(os.Stderr, "               Queue up to N connections waiting to be accepted, for bursty traffic.\n")
+        fmt.Fprintf(os.Stderr, "               The kernel caps N at net.core.somaxconn on Linux (which Go uses by\n")
+        fmt.Fprintf(os.Stderr, "               default) or kern.ipc.somaxconn on BSDs and macOS. Elsewhere, e.g. on\n")
+        fmt.Fprintf(os.Stderr, "               Windows, it is ignored with a warning. 0 (the default) leaves it be\n")
+        fmt.Fprintf(os.Stderr, "  -max-header-bytes=N\n")
+        fmt.Fprintf(os.Stderr, "               Largest request header to accept, in bytes. Defaults to %d\n", http.DefaultMaxHeaderBytes)
+        fmt.Fprintf(os.Stderr, "  -max-body-bytes=N\n")
+        fmt.Fprintf(os.Stderr, "               Largest request body to accept, in bytes. 0 means no limit.\n")
+        fmt.Fprintf(os.Stderr, "               Defaults to 10485760 (10MB)\n")
+        fmt.Fprintf(os.Stderr, "  -max-file-size=N\n")
+        fmt.Fprintf(os.Stderr, "               Answer 413 to requests for files larger than N bytes. 0 (the default)\n")
+        fmt.Fprintf(os.Stderr, "               means no limit\n")
+        fmt.Fprintf(os.Stderr, "  -rate-limit=N\n")
+        fmt.Fprintf(os.Stderr, "               Allow each client IP N requests per second (N may be fractional),\n")
+        fmt.Fprintf(os.Stderr, "               answering 429 Too Many Requests beyond that. 0 (the default) means no limit\n")
+        fmt.Fprintf(os.Stderr, "  -trusted-proxies=CIDRS\n")
+        fmt.Fprintf(os.Stderr, "               Take the client IP from X-Forwarded-For on requests from these\n")
+        fmt.Fprintf(os.Stderr, "               proxies (separated by commas), for the access log, -allow, -deny\n")
+        fmt.Fprintf(os.Stderr, "               and -rate-limit. Anyone else's X-Forwarded-For is ignored\n")
+        fmt.Fprintf(os.Stderr, "  -allow=CIDRS Only serve clients whose IP is in one of CIDRS, separated by commas,\n")
+        fmt.Fprintf(os.Stderr, "               e.g. 192.168.0.0/16,fd00::/8. Others get 403 Forbidden\n")
+        fmt.Fprintf(os.Stderr, "  -deny=CIDRS  Answer 403 Forbidden to clients whose IP is in one of CIDRS, even\n")
+        fmt.Fprintf(os.Stderr, "               if -allow lets them in\n")
+        fmt.Fprintf(os.Stderr, "  -gzip        Compress responses with gzip for clients that accept it\n")
+        fmt.Fprintf(os.Stderr, "  -gzip-level=N\n")
+        fmt.Fprintf(os.Stderr, "               gzip compression level, from 1 (fastest) to 9 (smallest). Default 6\n")
+        fmt.Fprintf(os.Stderr, "  -gzip-min=BYTES\n")
+        fmt.Fprintf(os.Stderr, "               Send responses shorter than BYTES uncompressed, with gzip or Brotli,\n")
+        fmt.Fprintf(os.Stderr, "               since small ones barely shrink. Default 0, to compress them all\n")
+        fmt.Fprintf(os.Stderr, "  -brotli      Compress responses with Brotli (br) for clients that accept it,\n")
+        fmt.Fprintf(os.Stderr, "               preferred over gzip\n")
+        fmt.Fprintf(os.Stderr, "  -precompressed\n")
+        fmt.Fprintf(os.Stderr, "               Serve FILE.br or FILE.gz, when present next to FILE, to clients that\n")
+        fmt.Fprintf(os.Stderr, "               accept that encoding, instead of compressing FILE on every request\n")
+        fmt.Fprintf(os.Stderr, "  -cert=FILE   PEM certificate (with any intermediates) to serve HTTPS with, instead\n")
+        fmt.Fprintf(os.Stderr, "               of a self-signed one. Needs -key. Both files are read again on\n")
+        fmt.Fprintf(os.Stderr, "               SIGHUP, so a renewed certificate (e.g. from certbot) is picked up\n")
+        fmt.Fprintf(os.Stderr, "               without dropping connections\n")
+        fmt.Fprintf(os.Stderr, "  -key=FILE    PEM private key for -cert\n")
+        fmt.Fprintf(os.Stderr, "  -cert-org=ORG\n")
+        fmt.Fprintf(os.Stderr, "               Organization for the self-signed certificate. Defaults to Acme Co\n")
+        fmt.Fprintf(os.Stderr, "  -cert-days=N Days the self-signed certificate is valid for. Defaults to 365\n")
+        fmt.Fprintf(os.Stderr, "  -acme-domains=DOMAINS\n")
+        fmt.Fprintf(os.Stderr, "               Get certificates for DOMAINS (separated by commas) from Let's\n")
+        fmt.Fprintf(os.Stderr, "               Encrypt instead of using a self-signed one. The HTTP ports answer\n")
+        fmt.Fprintf(os.Stderr, "               the ACME HTTP-01 challenges\n")
+        fmt.Fprintf(os.Stderr, "  -acme-cache=DIR\n")
+        fmt.Fprintf(os.Stderr, "               Directory to keep Let's Encrypt certificates in. Defaults to acme-cache\n")
+        fmt.Fprintf(os.Stderr, "  -no-http2    Only speak HTTP/1.1 on the HTTPS ports\n")
+        fmt.Fprintf(os.Stderr, "  -debug-tls   Log what each client offers in its TLS hello and what each handshake\n")
+        fmt.Fprintf(os.Stderr, "               settles on. Failed handshakes are always logged\n")
+        fmt.Fprintf(os.Stderr, "  -open        Open the first address in the default browser once listening\n")
+        fmt.Fprintf(os.Stderr, "  -selftest    Once listening, GET / from every address (accepting the self-signed\n")
+        fmt.Fprintf(os.Stderr, "               certificate) and exit with an error if any can't be reached\n")
+        fmt.Fprintf(os.Stderr, "  -handler-timeout=DURATION\n")
+        fmt.Fprintf(os.Stderr, "               Answer 503 Service Unavailable to requests that take longer than\n")
+        fmt.Fprintf(os.Stderr, "               DURATION. 0 (the default) means no limit\n")
+        fmt.Fprintf(os.Stderr, "  -slow-threshold=DURATION\n")
+        fmt.Fprintf(os.Stderr, "               After the access log line of a request that took longer than\n")
+        fmt.Fprintf(os.Stderr, "               DURATION, log a WARNING line with its URI and response time\n")
+        fmt.Fprintf(os.Stderr, "  -shutdown-timeout=DURATION\n")
+        fmt.Fprintf(os.Stderr, "               On Ctrl-C or SIGTERM, how long to let in-flight requests finish\n")
+        fmt.Fprintf(os.Stderr, "               before closing their connections. Defaults to 10s. A second Ctrl-C\n")
+        fmt.Fprintf(os.Stderr, "               or SIGTERM exits at once\n")
+        fmt.Fprintf(os.Stderr, "  -cpuprofile=FILE\n")
+        fmt.Fprintf(os.Stderr, "               Write a CPU profile to FILE, from startup until shutdown\n")
+        fmt.Fprintf(os.Stderr, "  -memprofile=FILE\n")
+        fmt.Fprintf(os.Stderr, "               Write a heap profile to FILE on shutdown\n")
+        fmt.Fprintf(os.Stderr, "  -pprof       Serve the net/http/pprof debugging endpoints under /debug/pprof/.\n")
+        fmt.Fprintf(os.Stderr, "               They expose the server's internals, so this is off by default\n")
+        fmt.Fprintf(os.Stderr, "  -pprof-addr=ADDR\n")
+        fmt.Fprintf(os.Stderr, "               Serve the pprof endpoints on ADDR (e.g. localhost:6060) instead,\n")
+        fmt.Fprintf(os.Stderr, "               apart from the files. Implies -pprof\n")
+        fmt.Fprintf(os.Stderr, "  -healthz     Answer /healthz with 503 until every listener is serving, then 200,\n")
+        fmt.Fprintf(os.Stderr, "               for readiness probes. Not in the access log\n")
+        fmt.Fprintf(os.Stderr, "  -admin-shutdown=TOKEN\n")
+        fmt.Fprintf(os.Stderr, "               Shut down gracefully on a POST to /__shutdown with the header\n")
+        fmt.Fprintf(os.Stderr, "               Authorization: Bearer TOKEN. Without the token it answers 403\n")
+        fmt.Fprintf(os.Stderr, "  -dryrun      Check the options, print what would be served and exit\n")
+        fmt.Fprintf(os.Stderr, "  -version, -V Print the version and exit\n")
         fmt.Fprintf(os.Stderr, "Report bugs to <ryan@rchapman.org>.\n")
     }
     flag.StringVar(&gHTTPPortsCSV,  "p",  "80",  "HTTP ports to listen on, separated by commas. E.g. -p 80,8080")
     flag.StringVar(&gHTTPSPortsCSV, "sp", "443", "HTTPS ports to listen on, separated by commas. E.g. -p 443,4433")
-}
-
-func cleanup() {
-    os.Remove(gCertFile)
-    os.Remove(gKeyFile)
+    flag.StringVar(&gDir,           "dir", ".", "Directory to serve")
+    flag.BoolVar(&gEmbedded,        "embedded", false, "Serve the files built into the binary instead of -dir")
+    flag.StringVar(&gVHosts,        "vhost", "", "host=dir pairs, separated by commas, to serve per Host header")
+    flag.BoolVar(&gFollowSymlinks,  "follow-symlinks", false, "Serve symlinks that point outside the directory")
+    flag.StringVar(&gListen,        "listen", "", "URLs to listen on, separated by commas. E.g. -listen http://:8080,https://:8443")
+    flag.StringVar(&gUnixSocket,    "unix", "", "Unix domain socket to serve plain HTTP on as well, e.g. for a reverse proxy")
+    flag.StringVar(&gConfigFile,    "config", "", "Config file of key=value options. Command line flags take precedence")
+    flag.BoolVar(&gSPA,             "spa", false, "Serve /index.html for missing extensionless paths (single-page apps)")
+    flag.BoolVar(&gShowVersion,     "version", false, "Print the version and exit")
+    flag.BoolVar(&gShowVersion,     "V", false, "Print the version and exit")
+    flag.IntVar(&gCacheMaxAge,      "cache-max-age", 0, "Cache-Control max-age in seconds for file responses. 0 disables")
+    flag.StringVar(&gPrefix,        "prefix", "", "URL path to serve the directory under, e.g. /files/")
+    flag.StringVar(&gProxies,       "proxy", "", "prefix=url pairs, separated by commas, of paths to reverse-proxy to a backend")
+    flag.StringVar(&gRootRedirect,  "root-redirect", "", "Path to redirect requests for / to, e.g. /docs/index.html")
+    flag.StringVar(&gBannerFile,    "banner-file", "", "HTML file to serve at /, ahead of any index.html")
+    flag.BoolVar(&gReadOnly,        "read-only", true, "Answer 405 to methods other than GET and HEAD (and PUT with -upload)")
+    flag.BoolVar(&gUpload,          "upload", false, "Accept PUT requests, storing the body at the request path")
+    flag.BoolVar(&gForceDownload,   "force-download", false, "Send files as attachments, so browsers save them")
+    flag.StringVar(&gDownloadExts,  "download-exts", "", "Limit -force-download to these extensions, separated by commas")
+    flag.StringVar(&gIndex,         "index", "", "Index file names to try in order for directories, separated by commas")
+    flag.StringVar(&gErrorPages,    "error-pages", "", "code=file pairs, separated by commas, of HTML pages for error responses")
+    flag.StringVar(&gListingTemplate, "listing-template", "", "html/template file to render directory listings with")
+    flag.StringVar(&gMIMETypes,     "mime-types", "", "ext=type pairs, separated by commas, to add to the MIME type table")
+    flag.StringVar(&gCharset,       "charset", "utf-8", "Charset to add to text Content-Types without one. Empty turns it off")
+    flag.StringVar(&gCORS,          "cors", "", "Origins allowed to make cross-origin requests, separated by commas, or *")
+    flag.StringVar(&gCSP,           "csp", "", "Content-Security-Policy header to send")
+    flag.StringVar(&gHSTS,          "hsts", "", "Strict-Transport-Security header to send on HTTPS responses")
+    flag.StringVar(&gFrameOptions,  "frame-options", "", "X-Frame-Options header to send, e.g. DENY")
+    flag.StringVar(&gServerHeader,  "server-header", "", "Server header to send, or - to send none")
+    flag.StringVar(&gLogFormat,     "log-format", "common", "Access log format: common, combined or json")
+    flag.StringVar(&gLogTemplate,   "log-template", "", "Apache LogFormat-style layout for access log lines")
+    flag.BoolVar(&gLogTLS,          "log-tls", false, "Log the TLS version and cipher suite of each request")
+    flag.BoolVar(&gLogResolve,      "log-resolve", false, "Log client hostnames from reverse DNS instead of IPs. Adds latency")
+    flag.BoolVar(&gLogSNI,          "log-sni", false, "Log the server name each HTTPS client asked for with SNI")
+    flag.StringVar(&gSyslog,        "syslog", "", "Send the access log to syslog: local, or a remote host:port")
+    flag.StringVar(&gLogFile,       "logfile", "", "Also append the access log to this file")
+    flag.IntVar(&gLogBuffer,        "access-log-buffer", 0, "Buffer this many bytes of the access log, flushed every second")
+    flag.BoolVar(&gLogMicros,       "log-micros", false, "Log response times in microseconds instead of seconds")
+    flag.BoolVar(&gLogUTC,          "log-utc", false, "Log times in UTC instead of local time")
+    flag.BoolVar(&gLogNoQuery,      "log-no-query", false, "Leave query strings out of the access log")
+    flag.BoolVar(&gDump,            "dump", false, "Write request and response headers to stderr for debugging")
+    flag.IntVar(&gLogSample,        "log-sample", 1, "Log one in this many successful requests. Errors are always logged")
+    flag.StringVar(&gLogSkip,       "log-skip", "", "Path prefixes to leave out of the access log, separated by commas")
+    flag.BoolVar(&gRequestID,       "request-id", false, "Give each request an ID, return it in X-Request-ID and log it")
+    flag.IntVar(&gMaxConns,         "max-conns", 0, "Most connections to serve at once. 0 means no limit")
+    flag.DurationVar(&gKeepAlive,   "keepalive", 15*time.Second, "TCP keep-alive period for connections. 0 turns keep-alive off")
+    flag.IntVar(&gAutoPort,         "auto-port", 0, "Ports to try after one that is in use. 0 fails instead")
+    flag.BoolVar(&gReusePort,       "reuseport", false, "Bind with SO_REUSEPORT so several instances can share the ports")
+    flag.IntVar(&gListenBacklog,    "listen-backlog", 0, "Accept queue length of the listening sockets; 0 for the system's default")
+    flag.IntVar(&gMaxHeaderBytes,   "max-header-bytes", http.DefaultMaxHeaderBytes, "Largest request header to accept, in bytes")
+    flag.Int64Var(&gMaxBodyBytes,   "max-body-bytes", 10<<20, "Largest request body to accept, in bytes. 0 means no limit")
+    flag.Int64Var(&gMaxFileSize,    "max-file-size", 0, "Largest file to serve, in bytes. 0 means no limit")
+    flag.Float64Var(&gRateLimit,    "rate-limit", 0, "Requests per second allowed from each client IP. 0 means no limit")
+    flag.StringVar(&gTrustedProxies, "trusted-proxies", "", "CIDR ranges of proxies whose X-Forwarded-For header is trusted")
+    flag.StringVar(&gAllow,         "allow", "", "CIDR ranges allowed access, separated by commas. Empty allows all")
+    flag.StringVar(&gDeny,          "deny", "", "CIDR ranges refused access, separated by commas")
+    flag.StringVar(&gCertFile,      "cert", "", "PEM certificate to serve HTTPS with, read again on SIGHUP")
+    flag.StringVar(&gKeyFile,       "key", "", "PEM private key for -cert")
+    flag.StringVar(&gCertOrg,       "cert-org", "Acme Co", "Organization for the self-signed certificate")
+    flag.IntVar(&gCertDays,         "cert-days", 365, "Days the self-signed certificate is valid for")
+    flag.StringVar(&gACMEDomains,   "acme-domains", "", "Domains to get Let's Encrypt certificates for, separated by commas")
+    flag.StringVar(&gACMECache,     "acme-cache", "acme-cache", "Directory to cache Let's Encrypt certificates in")
+    flag.BoolVar(&gDisableHTTP,     "disable-http", false, "Don't serve plain HTTP at all")
+    flag.BoolVar(&gDisableHTTPS,    "disable-https", false, "Don't serve HTTPS at all")
+    flag.BoolVar(&gNoHTTP2,         "no-http2", false, "Disable HTTP/2 on the HTTPS ports")
+    flag.BoolVar(&gDebugTLS,        "debug-tls", false, "Log each TLS client hello and completed handshake")
+    flag.BoolVar(&gOpen,            "open", false, "Open the first address in the default browser once listening")
+    flag.BoolVar(&gSelfTest,        "selftest", false, "GET / from every address once listening and exit if any fails")
+    flag.DurationVar(&gHandlerTimeout, "handler-timeout", 0, "Answer 503 to requests that take longer than this. 0 means no limit")
+    flag.DurationVar(&gSlowThreshold, "slow-threshold", 0, "Log a warning for requests that take longer than this. 0 disables")
+    flag.DurationVar(&gShutdownTimeout, "shutdown-timeout", 10*time.Second, "How long to wait for in-flight requests on shutdown")
+    flag.StringVar(&gCPUProfile,    "cpuprofile", "", "Write a CPU profile to this file until shutdown")
+    flag.StringVar(&gMemProfile,    "memprofile", "", "Write a heap profile to this file on shutdown")
+    flag.BoolVar(&gPProf,           "pprof", false, "Serve the net/http/pprof endpoints under /debug/pprof/")
+    flag.BoolVar(&gHealth,          "healthz", false, "Answer /healthz with 503 until every listener is serving, then 200")
+    flag.StringVar(&gPProfAddr,     "pprof-addr", "", "Serve the pprof endpoints on this address instead of with the files")
+    flag.StringVar(&gAdminShutdown, "admin-shutdown", "", "Shut down gracefully on a POST to /__shutdown carrying this token")
+    flag.BoolVar(&gDryRun,          "dryrun", false, "Check the options, print what would be served and exit")
+    flag.BoolVar(&gPrecompressed,   "precompressed", false, "Serve FILE.br or FILE.gz in place of FILE to clients that accept them")
+    flag.BoolVar(&gGzip,            "gzip", false, "Compress responses with gzip for clients that accept it")
+    flag.IntVar(&gGzipLevel,        "gzip-level", 6, "gzip compression level, from 1 (fastest) to 9 (smallest)")
+    flag.IntVar(&gGzipMin,          "gzip-min", 0, "Send responses shorter than this many bytes uncompressed")
+    flag.BoolVar(&gBrotli,          "brotli", false, "Compress responses with Brotli for clients that accept it, ahead of gzip")
+    flag.BoolVar(&gETag,            "etag", false, "Send a strong ETag computed from file size and modification time")
 }
 
 func main() {
-    // Handle Ctrl-C
-    c := make(chan os.Signal, 1)
-    signal.Notify(c, os.Interrupt)
-    go func() {
-        for _ = range c {
-            fmt.Printf("\nCtrl-C: ")
-            cleanup()
-            os.Exit(1)
-        }
-    }()
-
     flag.Parse()
-
-    if gHTTPPortsCSV == "80" {
-        gHTTPPorts = []string{"80"}
-    } else {
-        gHTTPPorts = strings.Split(gHTTPPortsCSV, ",")
+    if gShowVersion {
+        fmt.Println(versionString())
+        os.Exit(0)
     }
-
-    if gHTTPSPortsCSV == "443" {
-        gHTTPSPorts = []string{"443"}
-    } else {
-        gHTTPSPorts = strings.Split(gHTTPSPortsCSV, ",")
+    gCommandLine = make(map[string]bool)
+    flag.Visit(func(f *flag.Flag) {
+        gCommandLine[f.Name] = true
+    })
+    if err := loadOptions(); err != nil {
+        log.Fatalf("%s", err)
+    }
+    if gSyslog != "" {
+        w, err := webserver.SyslogWriter(gSyslog)
+        if err != nil {
+            log.Fatalf("%s", err)
+        }
+        defer w.Close()
+        gLogOut = w
+    }
+    if gLogFile != "" {
+        f, err := os.OpenFile(gLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+        if err != nil {
+            log.Fatalf("can't open log file: %s", err)
+        }
+        // only the file is ours to close, not stdout
+        defer f.Close()
+        gLogOut = io.MultiWriter(gLogOut, f)
+    }
+    if gLogBuffer > 0 {
+        if gSyslog != "" {
+            log.Fatalf("-access-log-buffer can't be used with -syslog, which needs one line per write")
+        }
+        // closed ahead of the log file, so the last lines make it in
+        w := webserver.NewBufferedWriter(gLogOut, gLogBuffer, time.Second)
+        defer w.Close()
+        gLogOut = w
+    }
+    config, err := newConfig()
+    if err != nil {
+        log.Fatalf("%s", err)
     }
 
-    mux := http.NewServeMux()
-    mux.Handle("/", http.FileServer(http.Dir(".")))
-    loggingHandler := apachelog.NewHandler(mux, os.Stdout)
-    wg := sync.WaitGroup{}
+    if gDryRun {
+        if _, err := webserver.BuildHandler(config); err != nil {
+            log.Fatalf("%s", err)
+        }
+        dir, err := filepath.Abs(gDir)
+        if err == nil && !gEmbedded {
+            _, err = os.Stat(dir)
+        }
+        if err != nil {
+            log.Fatalf("can't serve directory %s: %s", gDir, err)
+        }
+        if gEmbedded {
+            dir = "the embedded files"
+        }
+        for host, vhostDir := range config.VHosts {
+            if _, err := os.Stat(vhostDir); err != nil {
+                log.Fatalf("can't serve directory %s for %s: %s", vhostDir, host, err)
+            }
+        }
+        fmt.Printf("Would serve %s on\n", dir)
+        useTLS := false
+        for _, l := range config.Addrs {
+            fmt.Printf("  %s\n", l)
+            useTLS = useTLS || l.TLS
+        }
+        if gUnixSocket != "" {
+            fmt.Printf("  unix:%s\n", gUnixSocket)
+        }
+        if useTLS {
+            if len(config.ACMEDomains) > 0 {
+                fmt.Printf("using Let's Encrypt certificates for %s (cached in %s)\n", gACMEDomains, gACMECache)
+            } else if gCertFile != "" {
+                if _, err := tls.LoadX509KeyPair(gCertFile, gKeyFile); err != nil {
+                    log.Fatalf("failed to load certificate: %s", err)
+                }
+                fmt.Printf("using the certificate in %s\n", gCertFile)
+            } else {
+                if _, err := webserver.SelfSignedCert(gCertOrg, gCertDays); err != nil {
+                    log.Fatalf("%s", err)
+                }
+                fmt.Printf("using a self-signed certificate\n")
+            }
+        }
+        os.Exit(0)
+    }
 
-    for _, port := range gHTTPPorts {
-        server := &http.Server{
-            Addr:    fmt.Sprintf(":%s", port),
-            Handler: loggingHandler,
+    // Use the sockets systemd bound for us if we were socket activated,
+    // otherwise bind the addresses ourselves
+    sdListeners, sdNames := systemdListeners()
+    if len(sdListeners) > 0 {
+        config.Addrs = nil
+        for i, ln := range sdListeners {
+            config.Listeners = append(config.Listeners, webserver.Listener{Listener: ln, TLS: sdNames[i] == "https"})
         }
-        wg.Add(1)
-        go func() {
-            defer wg.Done()
-            server.ListenAndServe()
-        }()
-        fmt.Printf("Listening on port %s\n", port)
     }
-    
-    generateSelfSignedCert()
-    for _, port := range gHTTPSPorts {
-        server := &http.Server{
-            Addr:    fmt.Sprintf(":%s", port),
-            Handler: loggingHandler,
+    if len(config.Addrs) == 0 && len(config.Listeners) == 0 && gUnixSocket == "" {
+        log.Fatalf("nothing to listen on: all HTTP and HTTPS ports are disabled")
+    }
+    stopProfiling := startProfiling()
+    server := &webserver.Server{Config: config}
+    if err := server.Start(); err != nil {
+        if errors.Is(err, webserver.ErrPortInUse) {
+            if gAutoPort == 0 {
+                log.Fatalf("%s Try another port with -p or -sp, or -auto-port=N to look for a free one", err)
+            }
+            log.Fatalf("%s Try other ports with -p or -sp, or a larger -auto-port", err)
         }
-        wg.Add(1)
-        go func() {
-            defer wg.Done()
-            server.ListenAndServeTLS(gCertFile, gKeyFile)
-        }()
-        fmt.Printf("Listening on port %s\n", port)
+        log.Fatalf("%s", err)
+    }
+    for _, u := range server.URLs() {
+        fmt.Printf("Listening on %s\n", strings.TrimSuffix(u, "/"))
+    }
+    if gUnixSocket != "" {
+        fmt.Printf("Listening on unix socket %s\n", gUnixSocket)
+    }
+    if gPProfAddr != "" {
+        fmt.Printf("Serving pprof on http://%s/debug/pprof/\n", gPProfAddr)
+    }
+    if gSelfTest {
+        if failed := selfTest(server.URLs(), gUnixSocket); failed > 0 {
+            log.Fatalf("self-test failed: %d address(es) can't be reached", failed)
+        }
+    }
+    if urls := server.URLs(); gOpen && len(urls) > 0 {
+        openBrowser(urls[0])
     }
 
-    wg.Wait()
-    cleanup()
-}
+    // Reload the config file on SIGHUP
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+    go func() {
+        for range hup {
+            reload(server)
+        }
+    }()
 
+    // Shut down gracefully on Ctrl-C, termination by a process manager or a
+    // request to -admin-shutdown's endpoint
+    signal.Notify(gSignals, os.Interrupt, syscall.SIGTERM)
+    shuttingDown := make(chan struct{})
+    shutdownDone := make(chan struct{})
+    go func() {
+        sig := <-gSignals
+        fmt.Printf("\n%v: shutting down\n", sig)
+        close(shuttingDown)
+        go func() {
+            // a second Ctrl-C or SIGTERM means don't wait for stuck
+            // connections; another HTTP request to shut down doesn't
+            for sig := range gSignals {
+                if _, ok := sig.(shutdownRequest); !ok {
+                    fmt.Printf("%v again: exiting without waiting for connections\n", sig)
+                    os.Exit(1)
+                }
+            }
+        }()
+        ctx, cancel := context.WithTimeout(context.Background(), gShutdownTimeout)
+        defer cancel()
+        if err := server.Shutdown(ctx); err != nil {
+            log.Printf("%s", err)
+        }
+        close(shutdownDone)
+    }()
 
+    server.Wait()
+    // the servers stop serving as soon as shutdown starts, but in-flight
+    // requests may still be finishing
+    select {
+    case <-shuttingDown:
+        <-shutdownDone
+    default:
+    }
+    stopProfiling()
+}
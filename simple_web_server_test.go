@@ -0,0 +1,106 @@
+package main
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+)
+
+func TestParsePorts(t *testing.T) {
+    tests := []struct {
+        csv     string
+        want    []string
+        wantErr bool
+    }{
+        {"", nil, false},
+        {"  ", nil, false},
+        {"80", []string{"80"}, false},
+        {"80, 8080", []string{"80", "8080"}, false},
+        {"80,8080,80", []string{"80", "8080"}, false},
+        {"8000-8002,8001", []string{"8000", "8001", "8002"}, false},
+        {"1,65535", []string{"1", "65535"}, false},
+        {"0", nil, true},
+        {"65536", nil, true},
+        {"-1", nil, true},
+        {"80,abc", nil, true},
+        {"80,", nil, true},
+        {"8010-8000", nil, true},
+        {"1-2000", nil, true},
+    }
+    for _, tt := range tests {
+        got, err := parsePorts(tt.csv)
+        if (err != nil) != tt.wantErr {
+            t.Errorf("parsePorts(%q) error = %v, want error %v", tt.csv, err, tt.wantErr)
+            continue
+        }
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("parsePorts(%q) = %q, want %q", tt.csv, got, tt.want)
+        }
+    }
+}
+
+func TestParsePortsErrorNamesPort(t *testing.T) {
+    _, err := parsePorts("80,abc")
+    if err == nil || !strings.Contains(err.Error(), `"abc"`) {
+        t.Errorf("error %v doesn't name the bad port", err)
+    }
+}
+
+func TestPortsFromEnv(t *testing.T) {
+    defer func(http, https string) {
+        gHTTPPortsCSV, gHTTPSPortsCSV = http, https
+    }(gHTTPPortsCSV, gHTTPSPortsCSV)
+    t.Setenv("HTTP_PORTS", "8080,8081")
+    t.Setenv("HTTPS_PORTS", "8443")
+    tests := []struct {
+        given     map[string]bool
+        wantHTTP  []string
+        wantHTTPS []string
+    }{
+        // the environment beats the defaults...
+        {map[string]bool{}, []string{"8080", "8081"}, []string{"8443"}},
+        // ...but not flags given explicitly
+        {map[string]bool{"p": true}, []string{"80"}, []string{"8443"}},
+        {map[string]bool{"p": true, "sp": true}, []string{"80"}, []string{"443"}},
+    }
+    for _, tt := range tests {
+        gHTTPPortsCSV, gHTTPSPortsCSV = "80", "443"
+        portsFromEnv(tt.given)
+        httpPorts, err := parsePorts(gHTTPPortsCSV)
+        if err != nil {
+            t.Fatal(err)
+        }
+        httpsPorts, err := parsePorts(gHTTPSPortsCSV)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if !reflect.DeepEqual(httpPorts, tt.wantHTTP) || !reflect.DeepEqual(httpsPorts, tt.wantHTTPS) {
+            t.Errorf("with %v given: got %q and %q, want %q and %q", tt.given, httpPorts, httpsPorts, tt.wantHTTP, tt.wantHTTPS)
+        }
+    }
+}
+
+func TestNewConfigLogMicros(t *testing.T) {
+    defer func(format, template string, micros bool) {
+        gLogFormat, gLogTemplate, gLogMicros = format, template, micros
+    }(gLogFormat, gLogTemplate, gLogMicros)
+    tests := []struct {
+        format   string
+        template string
+        ok       bool
+    }{
+        {"common", "", true},
+        {"combined", "", false},
+        {"json", "", false},
+        {"common", "%h %D", false},
+    }
+    for _, tt := range tests {
+        gLogFormat, gLogTemplate, gLogMicros = tt.format, tt.template, true
+        _, err := newConfig()
+        if tt.ok && err != nil && strings.Contains(err.Error(), "log-micros") {
+            t.Errorf("-log-micros with -log-format=%s: %s", tt.format, err)
+        } else if !tt.ok && (err == nil || !strings.Contains(err.Error(), "log-micros")) {
+            t.Errorf("-log-micros with -log-format=%s and -log-template=%q: got %v, want an error", tt.format, tt.template, err)
+        }
+    }
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package webserver
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isAddrInUse reports whether err is from binding an address that's taken.
+func isAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
@@ -0,0 +1,16 @@
+package webserver
+
+import (
+	"errors"
+	"syscall"
+)
+
+// wsaeAddrInUse is WSAEADDRINUSE, what Winsock fails a bind with when the
+// address is taken. syscall.EADDRINUSE is only a stand-in on Windows, which
+// no socket call ever returns.
+const wsaeAddrInUse = syscall.Errno(10048)
+
+// isAddrInUse reports whether err is from binding an address that's taken.
+func isAddrInUse(err error) bool {
+	return errors.Is(err, wsaeAddrInUse)
+}
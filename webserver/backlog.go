@@ -0,0 +1,30 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package webserver
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// setBacklog sets the length of the queue of connections waiting to be
+// accepted on ln, by calling listen(2) again on its socket. The kernel caps
+// it: at net.core.somaxconn on Linux and kern.ipc.somaxconn on the BSDs and
+// macOS.
+func setBacklog(ln net.Listener, backlog int) error {
+	tl, ok := ln.(*net.TCPListener)
+	if !ok {
+		return fmt.Errorf("not a TCP listener")
+	}
+	rc, err := tl.SyscallConn()
+	if err != nil {
+		return err
+	}
+	if cerr := rc.Control(func(fd uintptr) {
+		err = syscall.Listen(int(fd), backlog)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package webserver
+
+import (
+	"errors"
+	"net"
+)
+
+// setBacklog would set the accept queue length of ln, but this platform
+// offers no way to change it once Go has listened, so it always fails.
+func setBacklog(ln net.Listener, backlog int) error {
+	return errors.New("setting the listen backlog is not supported on this platform")
+}
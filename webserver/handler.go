@@ -0,0 +1,1559 @@
+package webserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	apachelog "github.com/ryanchapman/go-simple-web-server/go-apachelog"
+	"golang.org/x/time/rate"
+)
+
+// safeJoin maps a request URL path to the file it names under root, and
+// returns an error if the result would be outside root. Every handler that
+// turns a request path into a file name goes through it, so none can be
+// talked into escaping root, e.g. with backslashes on Windows.
+func safeJoin(root, urlPath string) (string, error) {
+	name := filepath.Join(root, filepath.FromSlash(path.Clean("/"+urlPath)))
+	if !withinDir(filepath.Clean(root), name) {
+		return "", fmt.Errorf("%q is outside %s", urlPath, root)
+	}
+	return name, nil
+}
+
+// withinDir reports whether path is dir or somewhere below it. Both must be
+// clean, and both absolute or both relative.
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// symlinkFS is an http.Dir that, unless follow is set, refuses to open paths
+// that resolve through symlinks to somewhere outside the directory. It returns
+// os.ErrPermission for those, which http.FileServer answers with a 403.
+type symlinkFS struct {
+	http.Dir
+	realRoot string // the directory, absolute and with symlinks resolved
+	follow   bool
+}
+
+func newSymlinkFS(root string, follow bool) symlinkFS {
+	return symlinkFS{Dir: http.Dir(root), realRoot: realPath(root), follow: follow}
+}
+
+// realPath returns dir made absolute and with symlinks resolved, or as far
+// along that as it gets.
+func realPath(dir string) string {
+	abs, err := filepath.Abs(dir)
+	if err == nil {
+		if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+			abs = resolved
+		}
+	}
+	return abs
+}
+
+// resolvesWithin reports whether dir, or the nearest of its parents that
+// exists, resolves through any symlinks to somewhere in realRoot. Directories
+// made under it to reach dir, and files made in those, stay in realRoot too.
+func resolvesWithin(realRoot, dir string) (bool, error) {
+	for {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			return withinDir(realRoot, resolved), nil
+		}
+		parent := filepath.Dir(dir)
+		if !errors.Is(err, os.ErrNotExist) || parent == dir {
+			return false, err
+		}
+		dir = parent
+	}
+}
+
+func (fs symlinkFS) Open(name string) (http.File, error) {
+	if !fs.follow {
+		local, err := safeJoin(fs.realRoot, name)
+		if err != nil {
+			return nil, os.ErrPermission
+		}
+		resolved, err := filepath.EvalSymlinks(local)
+		if err == nil && !withinDir(fs.realRoot, resolved) {
+			return nil, os.ErrPermission
+		}
+	}
+	return fs.Dir.Open(name)
+}
+
+// singleFileFS is an http.FileSystem holding just the file name, at /.
+type singleFileFS string
+
+func (fs singleFileFS) Open(name string) (http.File, error) {
+	if path.Clean("/"+name) != "/" {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(string(fs))
+}
+
+// stat returns the FileInfo of the file at urlPath in fs.
+func stat(fs http.FileSystem, urlPath string) (os.FileInfo, error) {
+	f, err := fs.Open(path.Clean("/" + urlPath))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// listingEntry is one file or directory in a directory listing.
+type listingEntry struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// listing is what a listing template is executed with.
+type listing struct {
+	Path    string // the URL path of the directory, ending in /
+	Entries []listingEntry
+}
+
+// listingHandler renders directory listings from tmpl in place of
+// http.FileServer's, for directories under fs without an index.html.
+// Directories come first, then files, each sorted by name. Everything else,
+// including the redirect that adds a trailing slash, is left to next.
+func listingHandler(fs http.FileSystem, tmpl *template.Template, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		urlPath := path.Clean("/" + r.URL.Path)
+		if urlPath != "/" {
+			urlPath += "/"
+		}
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || !strings.HasSuffix(r.URL.Path, "/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if index, err := fs.Open(urlPath + "index.html"); err == nil {
+			index.Close()
+			next.ServeHTTP(w, r)
+			return
+		}
+		dir, err := fs.Open(urlPath)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer dir.Close()
+		if fi, err := dir.Stat(); err != nil || !fi.IsDir() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		infos, err := dir.Readdir(-1)
+		if err != nil {
+			log.Printf("listing of %s failed: %s", urlPath, err)
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		data := listing{Path: urlPath}
+		for _, fi := range infos {
+			data.Entries = append(data.Entries, listingEntry{
+				Name:    fi.Name(),
+				Size:    fi.Size(),
+				ModTime: fi.ModTime(),
+				IsDir:   fi.IsDir(),
+			})
+		}
+		sort.Slice(data.Entries, func(i, j int) bool {
+			a, b := data.Entries[i], data.Entries[j]
+			if a.IsDir != b.IsDir {
+				return a.IsDir
+			}
+			return a.Name < b.Name
+		})
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			log.Printf("listing of %s failed: %s", urlPath, err)
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			w.Write(buf.Bytes())
+		}
+	})
+}
+
+// indexHandler serves the first of names that exists as a regular file in a
+// requested directory under fs, ahead of http.FileServer's index.html. If
+// none does, the request is left to next, which serves index.html or lists
+// the directory.
+func indexHandler(fs http.FileSystem, names []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || !strings.HasSuffix(r.URL.Path, "/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		dir := path.Clean("/" + r.URL.Path)
+		for _, name := range names {
+			f, err := fs.Open(path.Join(dir, name))
+			if err != nil {
+				continue
+			}
+			fi, err := f.Stat()
+			if err != nil || !fi.Mode().IsRegular() {
+				f.Close()
+				continue
+			}
+			http.ServeContent(w, r, name, fi.ModTime(), f)
+			f.Close()
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// precompressedHandler serves the .br or .gz file next to a requested file
+// under fs, when the client accepts that encoding, in place of compressing
+// the file on the fly. Brotli is preferred. The response keeps the
+// Content-Type of the uncompressed file, and an ETag set further out gets
+// the encoding appended so the variants aren't mistaken for each other.
+func precompressedHandler(fs http.FileSystem, next http.Handler) http.Handler {
+	encodings := []struct{ coding, ext string }{{"br", ".br"}, {"gzip", ".gz"}}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || strings.HasSuffix(r.URL.Path, "/") || contentType == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		accept := r.Header.Get("Accept-Encoding")
+		for _, enc := range encodings {
+			f, err := fs.Open(name + enc.ext)
+			if err != nil {
+				continue
+			}
+			fi, err := f.Stat()
+			if err != nil || !fi.Mode().IsRegular() {
+				f.Close()
+				continue
+			}
+			addVary(w.Header(), "Accept-Encoding")
+			if !acceptsEncoding(accept, enc.coding) {
+				f.Close()
+				continue
+			}
+			h := w.Header()
+			h.Set("Content-Type", contentType)
+			h.Set("Content-Encoding", enc.coding)
+			if etag := h.Get("ETag"); strings.HasSuffix(etag, `"`) {
+				h.Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+enc.coding+`"`)
+			}
+			http.ServeContent(w, r, name, fi.ModTime(), f)
+			f.Close()
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// spaHandler serves the /index.html in fs for requests that match nothing in
+// it and don't look like a file (no extension), so that a single-page app's
+// client-side router can handle the route. Missing assets still 404.
+func spaHandler(fs http.FileSystem, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := stat(fs, r.URL.Path)
+		if errors.Is(err, os.ErrNotExist) && path.Ext(path.Clean("/"+r.URL.Path)) == "" {
+			index, err := fs.Open("/index.html")
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			defer index.Close()
+			fi, err := index.Stat()
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			http.ServeContent(w, r, "index.html", fi.ModTime(), index)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cacheHandler adds caching headers to responses for regular files: a
+// Cache-Control max-age when maxAge > 0, and when etag is set, a strong ETag
+// built from the file's modification time and size. http.FileServer uses the
+// ETag to answer If-None-Match requests with 304 Not Modified.
+func cacheHandler(fs http.FileSystem, maxAge int, etag bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fi, err := stat(fs, r.URL.Path)
+		if err == nil && fi.Mode().IsRegular() {
+			if maxAge > 0 {
+				w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+			}
+			if etag {
+				w.Header().Set("ETag", fmt.Sprintf("\"%x-%x\"", fi.ModTime().UnixNano(), fi.Size()))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maxFileSizeHandler answers 413 Request Entity Too Large to GET and HEAD
+// requests for regular files in fs that are larger than max bytes.
+// Directories and smaller files are passed on to next.
+func maxFileSizeHandler(fs http.FileSystem, max int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			fi, err := stat(fs, r.URL.Path)
+			if err == nil && fi.Mode().IsRegular() && fi.Size() > max {
+				http.Error(w, "413 Request Entity Too Large", http.StatusRequestEntityTooLarge)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// downloadHandler adds Content-Disposition: attachment, with the file's name,
+// to GET and HEAD requests for files whose extension is in exts, so browsers
+// save them instead of showing them. exts holding "*" matches every file.
+func downloadHandler(fs http.FileSystem, exts []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			fi, err := stat(fs, r.URL.Path)
+			if err == nil && fi.Mode().IsRegular() && matchesExt(fi.Name(), exts) {
+				// quotes and non-ASCII names are escaped as RFC 6266 wants
+				w.Header().Set("Content-Disposition",
+					mime.FormatMediaType("attachment", map[string]string{"filename": fi.Name()}))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// matchesExt reports whether name has one of exts, given with or without the
+// leading dot and compared case-insensitively, or exts holds "*".
+func matchesExt(name string, exts []string) bool {
+	ext := strings.TrimPrefix(path.Ext(name), ".")
+	for _, e := range exts {
+		if e == "*" || (ext != "" && strings.EqualFold(strings.TrimPrefix(e, "."), ext)) {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadHandler stores the body of PUT requests at the request path under root,
+// creating any missing parent directories, and answers 201 Created. The body
+// goes to a temporary file that replaces the target only once it's complete,
+// so a failed upload leaves any earlier file alone. Paths with ".." elements
+// are refused, and so, unless follow is set, are paths that lead through a
+// symlink to outside root or that name a symlink. Other methods are passed on
+// to next.
+func uploadHandler(root string, follow bool, next http.Handler) http.Handler {
+	realRoot := realPath(root)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, elem := range strings.Split(r.URL.Path, "/") {
+			if elem == ".." {
+				http.Error(w, "403 Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		if strings.HasSuffix(r.URL.Path, "/") {
+			http.Error(w, "can't upload to a directory", http.StatusBadRequest)
+			return
+		}
+		name, err := safeJoin(realRoot, r.URL.Path)
+		if err != nil {
+			http.Error(w, "403 Forbidden", http.StatusForbidden)
+			return
+		}
+		if !follow {
+			// MkdirAll and CreateTemp would follow a symlinked directory out
+			// of root, and the rename would replace a symlink to a file
+			// rather than write through it
+			within, err := resolvesWithin(realRoot, filepath.Dir(name))
+			if err != nil {
+				log.Printf("upload of %s failed: %s", r.URL.Path, err)
+				http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			if fi, err := os.Lstat(name); !within || (err == nil && fi.Mode()&os.ModeSymlink != 0) {
+				http.Error(w, "403 Forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			log.Printf("upload of %s failed: %s", r.URL.Path, err)
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".upload-*")
+		if err != nil {
+			log.Printf("upload of %s failed: %s", r.URL.Path, err)
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		_, err = io.Copy(f, r.Body)
+		if err == nil {
+			// CreateTemp makes it private; uploads are there to be served
+			err = f.Chmod(0644)
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), name)
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, "413 Request Entity Too Large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			log.Printf("upload of %s failed: %s", r.URL.Path, err)
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+}
+
+// methodsHandler answers 405 Method Not Allowed, with allow as the Allow
+// header, to requests whose method isn't one of methods. TRACE and CONNECT are
+// refused whatever methods holds, and with nil methods, only they are.
+func methodsHandler(methods []string, allow string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// TRACE echoes requests back, cookies and all, and CONNECT would
+		// make this a proxy; security scanners flag servers that answer them
+		if r.Method != http.MethodTrace && r.Method != http.MethodConnect {
+			if methods == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			for _, m := range methods {
+				if r.Method == m {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+		w.Header().Set("Allow", allow)
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	})
+}
+
+// corsHandler adds CORS headers for requests from the given origins ("*" allows
+// any origin) and answers preflight OPTIONS requests with the allowed methods
+// and a 204. Preflights from other origins get a 403.
+func corsHandler(origins []string, methods string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		allowed := false
+		for _, o := range origins {
+			if o == "*" || o == origin {
+				allowed = true
+				break
+			}
+		}
+		w.Header().Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !allowed {
+			if preflight {
+				http.Error(w, "403 Forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestIDKey is the request context key for the request's ID.
+type requestIDKey struct{}
+
+// requestIDHandler gives every request an ID, taken from an incoming
+// X-Request-ID header when it looks sane and randomly generated otherwise. The
+// ID is sent back in the X-Request-ID response header, where apachelog picks
+// it up, and stored in the request context under requestIDKey{}.
+func requestIDHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(apachelog.RequestIDHeader)
+		if !validRequestID(id) {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set(apachelog.RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID reports whether id is fit to pass along and log: not empty,
+// not too long and only printable ASCII without spaces.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// maxBodyHandler limits request bodies to n bytes. Reads past the limit fail
+// and the connection is closed once the handler returns.
+func maxBodyHandler(n int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// securityHeadersHandler sets the Content-Security-Policy, Strict-Transport-Security
+// and X-Frame-Options response headers to csp, hsts and frameOptions, leaving
+// out any that are empty. HSTS is only sent over HTTPS, as browsers ignore it
+// on plain HTTP.
+func securityHeadersHandler(csp, hsts, frameOptions string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if csp != "" {
+			w.Header().Set("Content-Security-Policy", csp)
+		}
+		if hsts != "" && r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", hsts)
+		}
+		if frameOptions != "" {
+			w.Header().Set("X-Frame-Options", frameOptions)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serverHeaderWriter sets the Server header to value, or deletes it if value
+// is empty, when the header is written, overriding any set by the handler.
+type serverHeaderWriter struct {
+	http.ResponseWriter
+	value       string
+	wroteHeader bool
+}
+
+func (w *serverHeaderWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if w.value == "" {
+			w.Header().Del("Server")
+		} else {
+			w.Header().Set("Server", w.value)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *serverHeaderWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *serverHeaderWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the ResponseWriter underneath,
+// for Hijack and the like, which the wrappers here don't pass on themselves.
+func (w *serverHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// serverHeaderHandler sends value as the Server header of every response, or
+// no Server header at all, not even a proxied backend's, if value is "-".
+func serverHeaderHandler(value string, next http.Handler) http.Handler {
+	if value == "-" {
+		value = ""
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&serverHeaderWriter{ResponseWriter: w, value: value}, r)
+	})
+}
+
+// charsetWriter adds a charset parameter to text Content-Types that lack one
+// when the header is written.
+type charsetWriter struct {
+	http.ResponseWriter
+	charset     string
+	wroteHeader bool
+}
+
+func (w *charsetWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.Header()
+		if ct := h.Get("Content-Type"); needsCharset(ct) {
+			h.Set("Content-Type", ct+"; charset="+w.charset)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *charsetWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *charsetWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *charsetWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// needsCharset reports whether contentType is text, JSON or JavaScript
+// without a charset parameter.
+func needsCharset(contentType string) bool {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["charset"] != "" {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" || mediaType == "application/javascript"
+}
+
+// charsetHandler appends "; charset=" and charset to text Content-Types
+// that don't say which one they use.
+func charsetHandler(charset string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&charsetWriter{ResponseWriter: w, charset: charset}, r)
+	})
+}
+
+// clientIP returns the IP address of the peer that sent r, or r.RemoteAddr
+// itself if it isn't a host:port pair.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// parseCIDRs parses CIDR ranges such as 10.0.0.0/8 or fd00::/8. A bare IP
+// address stands for just that address.
+func parseCIDRs(list []string) (nets []*net.IPNet, err error) {
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// ipFilterHandler answers 403 Forbidden to clients whose IP is in deny, or
+// isn't in allow when allow is non-empty. Deny wins over allow. Clients
+// without an IP, such as over a Unix socket, only get through when allow is
+// empty.
+func ipFilterHandler(allow, deny []*net.IPNet, next http.Handler) http.Handler {
+	contains := func(nets []*net.IPNet, ip net.IP) bool {
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := clientIP(r)
+		if i := strings.IndexByte(host, '%'); i >= 0 {
+			// an IPv6 zone, as in fe80::1%eth0
+			host = host[:i]
+		}
+		ip := net.ParseIP(host)
+		if (ip != nil && contains(deny, ip)) || (len(allow) > 0 && (ip == nil || !contains(allow, ip))) {
+			http.Error(w, "403 Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// realIPHandler replaces r.RemoteAddr with the client address from the
+// X-Forwarded-For header, for requests that come from one of the trusted
+// proxies. The header is read from the right, skipping trusted proxies, so
+// a client can't pass off a made-up address as its own. Requests from anyone
+// else keep their RemoteAddr, whatever headers they send.
+func realIPHandler(trusted []*net.IPNet, next http.Handler) http.Handler {
+	isTrusted := func(s string) bool {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return false
+		}
+		for _, n := range trusted {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded := r.Header.Values("X-Forwarded-For")
+		if len(forwarded) == 0 || !isTrusted(clientIP(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		client := ""
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			client = hop
+			if !isTrusted(hop) {
+				break
+			}
+		}
+		if client != "" {
+			_, port, _ := net.SplitHostPort(r.RemoteAddr)
+			r = r.Clone(r.Context())
+			r.RemoteAddr = net.JoinHostPort(client, port)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitIdle is how long a client's limiter is kept after its last
+// request. By then the limiter has refilled, so dropping it changes nothing.
+const rateLimitIdle = 3 * time.Minute
+
+// rateLimiter hands out a token bucket per client IP.
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	clients   map[string]*rateClient
+	lastSweep time.Time
+}
+
+type rateClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// get returns the limiter for ip, creating it if need be. Every so often it
+// first drops the limiters of clients that have gone idle, so the map doesn't
+// grow without bound.
+func (l *rateLimiter) get(ip string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastSweep) > time.Minute {
+		for ip, c := range l.clients {
+			if now.Sub(c.lastSeen) > rateLimitIdle {
+				delete(l.clients, ip)
+			}
+		}
+		l.lastSweep = now
+	}
+	c, ok := l.clients[ip]
+	if !ok {
+		c = &rateClient{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[ip] = c
+	}
+	c.lastSeen = now
+	return c.limiter
+}
+
+// rateLimitHandler lets each client IP make perSecond requests a second, with
+// bursts of up to perSecond (at least 1). Requests over the limit get a 429
+// Too Many Requests with a Retry-After header saying when to try again.
+func rateLimitHandler(perSecond float64, next http.Handler) http.Handler {
+	limiter := &rateLimiter{
+		limit:   rate.Limit(perSecond),
+		burst:   int(math.Ceil(perSecond)),
+		clients: make(map[string]*rateClient),
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reservation := limiter.get(clientIP(r)).Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			http.Error(w, "429 Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header value accept
+// allows coding, either by name or through "*", with a non-zero q-value.
+func acceptsEncoding(accept string, coding string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != coding && name != "*" {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q=")
+		if !ok {
+			return true
+		}
+		if v, err := strconv.ParseFloat(q, 64); err == nil && v > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// errorPageWriter replaces the body of responses whose status has a page in
+// pages with that page. Whatever the handler writes after such a status is
+// dropped.
+type errorPageWriter struct {
+	http.ResponseWriter
+	pages       map[int][]byte
+	method      string
+	wroteHeader bool
+	replaced    bool
+}
+
+func (w *errorPageWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if code >= 200 {
+		w.wroteHeader = true
+	}
+	page, ok := w.pages[code]
+	if !ok {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.replaced = true
+	h := w.Header()
+	h.Del("Content-Encoding")
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(len(page)))
+	w.ResponseWriter.WriteHeader(code)
+	if w.method != http.MethodHead {
+		w.ResponseWriter.Write(page)
+	}
+}
+
+func (w *errorPageWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *errorPageWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *errorPageWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// errorPagesHandler serves the pages in pages, by status code, in place of the
+// bodies of responses with those statuses.
+func errorPagesHandler(pages map[int][]byte, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&errorPageWriter{ResponseWriter: w, pages: pages, method: r.Method}, r)
+	})
+}
+
+// addVary adds field to the Vary header in h unless it's already there.
+func addVary(h http.Header, field string) {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
+
+// compressWriter compresses the body written through it once WriteHeader
+// decides the response is worth compressing: a 200 with a body whose
+// Content-Type isn't already compressed and that has no Content-Encoding yet.
+// Bodies shorter than min bytes are sent as they are. When the length isn't
+// known up front, up to min bytes are held back until it is clear which.
+type compressWriter struct {
+	http.ResponseWriter
+	coding      string
+	newEncoder  func(io.Writer) io.WriteCloser
+	min         int
+	head        bool // the request is HEAD, so there's no body to compress
+	encoder     io.WriteCloser
+	wroteHeader bool
+	pending     []byte // body held back while undecided
+	undecided   bool
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	addVary(h, "Accept-Encoding")
+	if code == http.StatusOK && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		if length, err := strconv.Atoi(h.Get("Content-Length")); err == nil && length < w.min {
+			w.ResponseWriter.WriteHeader(code)
+			return
+		} else if err != nil && w.min > 0 {
+			w.undecided = true
+			return
+		}
+		w.startEncoding()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// startEncoding sets the headers of a compressed response and the encoder
+// for its body. A strong ETag gets the coding appended, as precompressedHandler
+// does, since the compressed body isn't the one the ETag was made for.
+func (w *compressWriter) startEncoding() {
+	h := w.Header()
+	h.Set("Content-Encoding", w.coding)
+	if etag := h.Get("ETag"); strings.HasSuffix(etag, `"`) && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+w.coding+`"`)
+	}
+	h.Del("Content-Length")
+	// byte ranges of the file aren't byte ranges of what is sent
+	h.Del("Accept-Ranges")
+	if w.head {
+		// an encoder would still write its header and trailer, which
+		// net/http would then give as the Content-Length
+		return
+	}
+	w.encoder = w.newEncoder(w.ResponseWriter)
+}
+
+// decide sends the header held back by WriteHeader, compressing the body if
+// compress is set, followed by what was held back of the body.
+func (w *compressWriter) decide(compress bool) error {
+	w.undecided = false
+	if compress {
+		w.startEncoding()
+	}
+	w.ResponseWriter.WriteHeader(http.StatusOK)
+	pending := w.pending
+	w.pending = nil
+	if len(pending) == 0 {
+		return nil
+	}
+	var err error
+	if w.encoder != nil {
+		_, err = w.encoder.Write(pending)
+	} else {
+		_, err = w.ResponseWriter.Write(pending)
+	}
+	return err
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.undecided {
+		w.pending = append(w.pending, b...)
+		if len(w.pending) < w.min {
+			return len(b), nil
+		}
+		return len(b), w.decide(true)
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressWriter) Flush() {
+	if w.undecided {
+		// a flush means more is on the way, so it's worth compressing
+		w.decide(true)
+	}
+	if f, ok := w.encoder.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Close sends a body held back for being too short, uncompressed, or flushes
+// whatever the encoder still holds to the client.
+func (w *compressWriter) Close() error {
+	if w.undecided {
+		if len(w.pending) > 0 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(w.pending)))
+		}
+		return w.decide(false)
+	}
+	if w.encoder == nil {
+		return nil
+	}
+	return w.encoder.Close()
+}
+
+// compressible reports whether a response of contentType is likely to shrink.
+// Images, audio, video and archives are already compressed.
+func compressible(contentType string) bool {
+	if contentType == "" {
+		return false
+	}
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	mediaType = strings.TrimSpace(mediaType)
+	if strings.HasPrefix(mediaType, "image/") && mediaType != "image/svg+xml" {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "audio/") || strings.HasPrefix(mediaType, "video/") {
+		return false
+	}
+	switch mediaType {
+	case "application/zip", "application/gzip", "application/x-gzip", "application/x-bzip2",
+		"application/x-xz", "application/zstd", "application/x-7z-compressed", "application/pdf",
+		"font/woff", "font/woff2":
+		return false
+	}
+	return true
+}
+
+// compressHandler compresses responses for clients that accept it: with br
+// when useBrotli is set, otherwise or failing that with gzip at gzipLevel
+// when useGzip is set, and not at all if the client accepts neither.
+// Responses shorter than min bytes aren't compressed. Range requests for
+// files of a compressible type are answered with the whole file, compressed,
+// and compressed responses don't advertise Accept-Ranges.
+func compressHandler(useGzip bool, gzipLevel int, useBrotli bool, min int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept := r.Header.Get("Accept-Encoding")
+		cw := &compressWriter{ResponseWriter: w, min: min, head: r.Method == http.MethodHead}
+		switch {
+		case useBrotli && acceptsEncoding(accept, "br"):
+			cw.coding = "br"
+			cw.newEncoder = func(w io.Writer) io.WriteCloser {
+				return brotli.NewWriterLevel(w, brotli.DefaultCompression)
+			}
+		case useGzip && acceptsEncoding(accept, "gzip"):
+			cw.coding = "gzip"
+			cw.newEncoder = func(w io.Writer) io.WriteCloser {
+				// the level is checked by BuildHandler
+				zw, _ := gzip.NewWriterLevel(w, gzipLevel)
+				return zw
+			}
+		default:
+			if useGzip || useBrotli {
+				addVary(w.Header(), "Accept-Encoding")
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Header.Get("Range") != "" && compressible(mime.TypeByExtension(path.Ext(r.URL.Path))) {
+			// a 206 would go out uncompressed
+			r = r.Clone(r.Context())
+			r.Header.Del("Range")
+			r.Header.Del("If-Range")
+		}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// singleFileHandler serves the file name for requests to / and 404s for
+// everything else.
+func singleFileHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, name)
+	})
+}
+
+// fileHandler returns the file server for root, wrapped in the file-level
+// middleware enabled in cfg. Directory listings come from listing when it's
+// set. If root is a regular file rather than a directory, only that file is
+// served, at /. If cfg.FS is set, it is served in place of root.
+func fileHandler(root string, cfg Config, listing *template.Template) http.Handler {
+	var fs http.FileSystem
+	if cfg.FS != nil {
+		fs = http.FS(cfg.FS)
+	} else if fi, err := os.Stat(root); err == nil && fi.Mode().IsRegular() {
+		fs = singleFileFS(root)
+		var fileServer http.Handler = singleFileHandler(root)
+		if cfg.CacheMaxAge > 0 || cfg.ETag {
+			fileServer = cacheHandler(fs, cfg.CacheMaxAge, cfg.ETag, fileServer)
+		}
+		if cfg.MaxFileSize > 0 {
+			fileServer = maxFileSizeHandler(fs, cfg.MaxFileSize, fileServer)
+		}
+		if len(cfg.Downloads) > 0 {
+			fileServer = downloadHandler(fs, cfg.Downloads, fileServer)
+		}
+		return fileServer
+	} else {
+		fs = newSymlinkFS(root, cfg.FollowSymlinks)
+	}
+	var fileServer http.Handler = http.FileServer(fs)
+	if listing != nil {
+		fileServer = listingHandler(fs, listing, fileServer)
+	}
+	if len(cfg.Index) > 0 {
+		fileServer = indexHandler(fs, cfg.Index, fileServer)
+	}
+	if cfg.Precompressed {
+		fileServer = precompressedHandler(fs, fileServer)
+	}
+	if cfg.SPA {
+		fileServer = spaHandler(fs, fileServer)
+	}
+	if cfg.CacheMaxAge > 0 || cfg.ETag {
+		fileServer = cacheHandler(fs, cfg.CacheMaxAge, cfg.ETag, fileServer)
+	}
+	if cfg.MaxFileSize > 0 {
+		fileServer = maxFileSizeHandler(fs, cfg.MaxFileSize, fileServer)
+	}
+	if len(cfg.Downloads) > 0 {
+		fileServer = downloadHandler(fs, cfg.Downloads, fileServer)
+	}
+	if cfg.Upload {
+		fileServer = uploadHandler(root, cfg.FollowSymlinks, fileServer)
+	}
+	return fileServer
+}
+
+// handlePProf registers the net/http/pprof handlers on mux under
+// /debug/pprof/.
+func handlePProf(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// ShutdownPath is where a shutdown can be requested when Config.ShutdownToken
+// is set.
+const ShutdownPath = "/__shutdown"
+
+// shutdownHandler answers POST requests carrying "Authorization: Bearer
+// token" with 202 Accepted and then calls onShutdown. Requests without the
+// token get a 403, and other methods a 405.
+func shutdownHandler(token string, onShutdown func()) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "403 Forbidden", http.StatusForbidden)
+			return
+		}
+		http.Error(w, "shutting down", http.StatusAccepted)
+		onShutdown()
+	})
+}
+
+// rootRedirectHandler answers requests for exactly / with a 302 to target and
+// passes everything else to next.
+func rootRedirectHandler(target string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			http.Redirect(w, r, target, http.StatusFound)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bannerHandler serves the file name for GET and HEAD requests for exactly
+// root, the top of the files, ahead of any index.html there, and passes
+// everything else to next.
+func bannerHandler(name, root string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == root && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			http.ServeFile(w, r, name)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statusWriter remembers the status of the response written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// dumpHandler writes each request's line and headers, and the status and
+// headers of the response, to out once the response is done. Bodies are
+// left out, so the request body is still there for next to read.
+func dumpHandler(out io.Writer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dump, err := httputil.DumpRequest(r, false)
+		if err != nil {
+			dump = []byte(fmt.Sprintf("(can't dump request: %s)\r\n\r\n", err))
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "--- request from %s\n", r.RemoteAddr)
+		buf.Write(dump)
+		fmt.Fprintf(&buf, "--- response %d %s\n", sw.status, http.StatusText(sw.status))
+		w.Header().Write(&buf)
+		buf.WriteString("\n")
+		// in one write, so dumps of concurrent requests don't interleave
+		out.Write(bytes.ReplaceAll(buf.Bytes(), []byte("\r\n"), []byte("\n")))
+	})
+}
+
+// vhostHandler sends each request to the handler for its Host, ignoring any
+// port, or to fallback when no handler matches.
+func vhostHandler(hosts map[string]http.Handler, fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(strings.Trim(host, "[]"))
+		if h, ok := hosts[host]; ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		fallback.ServeHTTP(w, r)
+	})
+}
+
+// BuildHandler puts together the file server, the middleware around it and the
+// access logging described by cfg. It's everything a Server serves, minus the
+// listeners, so it can be exercised with httptest or mounted in another mux.
+func BuildHandler(cfg Config) (http.Handler, error) {
+	// older mime tables lack .wasm, and browsers only compile WebAssembly
+	// served as application/wasm
+	mime.AddExtensionType(".wasm", "application/wasm")
+	for ext, typ := range cfg.MIMETypes {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if err := mime.AddExtensionType(ext, typ); err != nil {
+			return nil, fmt.Errorf("invalid MIME type %q for %s: %s", typ, ext, err)
+		}
+	}
+	var listing *template.Template
+	if cfg.ListingTemplate != "" {
+		var err error
+		listing, err = template.ParseFiles(cfg.ListingTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listing template: %s", err)
+		}
+	}
+	if cfg.FS != nil && cfg.Upload {
+		return nil, errors.New("can't accept uploads into an fs.FS")
+	}
+	fileServer := fileHandler(cfg.Root, cfg, listing)
+	if len(cfg.VHosts) > 0 {
+		// FS stands in for Root only; virtual hosts are served from disk
+		vhostCfg := cfg
+		vhostCfg.FS = nil
+		hosts := make(map[string]http.Handler)
+		for host, root := range cfg.VHosts {
+			hosts[strings.ToLower(host)] = fileHandler(root, vhostCfg, listing)
+		}
+		fileServer = vhostHandler(hosts, fileServer)
+	}
+	// what a 405 gives as allowed, whichever filter refuses the method
+	methods := []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions}
+	if cfg.ReadOnly {
+		methods = []string{http.MethodGet, http.MethodHead}
+		if cfg.Upload {
+			methods = append(methods, http.MethodPut)
+		}
+		fileServer = methodsHandler(methods, strings.Join(methods, ", "), fileServer)
+	}
+	mux := http.NewServeMux()
+	if prefix := strings.Trim(cfg.Prefix, "/"); prefix != "" {
+		// the access log still shows the original path; only the file
+		// server sees it with the prefix removed
+		mux.Handle("/"+prefix+"/", http.StripPrefix("/"+prefix, fileServer))
+	} else {
+		mux.Handle("/", fileServer)
+	}
+	for prefix, target := range cfg.Proxies {
+		if strings.Trim(prefix, "/") == "" {
+			return nil, fmt.Errorf("invalid proxy prefix %q: / is the file server's", prefix)
+		}
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy target %q for %s: expected an http or https URL", target, prefix)
+		}
+		// the whole path is passed on, prefix and all, after the target's own
+		mux.Handle("/"+strings.Trim(prefix, "/")+"/", httputil.NewSingleHostReverseProxy(u))
+	}
+	if cfg.PProf {
+		// more specific than any pattern for the files, so always wins
+		handlePProf(mux)
+	}
+	if cfg.ShutdownToken != "" && cfg.OnShutdown != nil {
+		mux.Handle(ShutdownPath, shutdownHandler(cfg.ShutdownToken, cfg.OnShutdown))
+	}
+	// TRACE and CONNECT are refused for everything, not just the files
+	handler := methodsHandler(nil, strings.Join(methods, ", "), mux)
+	if cfg.BannerFile != "" {
+		if _, err := os.Stat(cfg.BannerFile); err != nil {
+			return nil, fmt.Errorf("invalid banner file: %s", err)
+		}
+		root := "/"
+		if prefix := strings.Trim(cfg.Prefix, "/"); prefix != "" {
+			root = "/" + prefix + "/"
+		}
+		handler = bannerHandler(cfg.BannerFile, root, handler)
+	}
+	if cfg.RootRedirect != "" {
+		handler = rootRedirectHandler(cfg.RootRedirect, handler)
+	}
+	if cfg.Timeout > 0 {
+		handler = http.TimeoutHandler(handler, cfg.Timeout, "503 Service Unavailable: request timed out\n")
+	}
+	if len(cfg.CORSOrigins) > 0 {
+		methods := "GET, HEAD, OPTIONS"
+		if cfg.Upload {
+			methods = "GET, HEAD, PUT, OPTIONS"
+		}
+		handler = corsHandler(cfg.CORSOrigins, methods, handler)
+	}
+	if cfg.Charset != "" {
+		handler = charsetHandler(cfg.Charset, handler)
+	}
+	if cfg.CSP != "" || cfg.HSTS != "" || cfg.FrameOptions != "" {
+		handler = securityHeadersHandler(cfg.CSP, cfg.HSTS, cfg.FrameOptions, handler)
+	}
+	if cfg.ServerHeader != "" {
+		handler = serverHeaderHandler(cfg.ServerHeader, handler)
+	}
+	if cfg.MaxBodyBytes > 0 {
+		handler = maxBodyHandler(cfg.MaxBodyBytes, handler)
+	}
+	if cfg.RequestID {
+		handler = requestIDHandler(handler)
+	}
+	if cfg.RateLimit > 0 {
+		handler = rateLimitHandler(cfg.RateLimit, handler)
+	}
+	if len(cfg.Allow) > 0 || len(cfg.Deny) > 0 {
+		allow, err := parseCIDRs(cfg.Allow)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow list: %s", err)
+		}
+		deny, err := parseCIDRs(cfg.Deny)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deny list: %s", err)
+		}
+		// ahead of the rate limiter, so denied clients don't use up tokens
+		handler = ipFilterHandler(allow, deny, handler)
+	}
+	if len(cfg.ErrorPages) > 0 {
+		pages := make(map[int][]byte)
+		for code, name := range cfg.ErrorPages {
+			page, err := os.ReadFile(name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid error page for %d: %s", code, err)
+			}
+			pages[code] = page
+		}
+		handler = errorPagesHandler(pages, handler)
+	}
+	// compression goes last so the access log counts the bytes actually sent
+	if cfg.Gzip || cfg.Brotli {
+		level := cfg.GzipLevel
+		if level == 0 {
+			level = gzip.DefaultCompression
+		} else if level < gzip.BestSpeed || level > gzip.BestCompression {
+			return nil, fmt.Errorf("invalid gzip level %d: expected 1 to 9", level)
+		}
+		handler = compressHandler(cfg.Gzip, level, cfg.Brotli, cfg.CompressMin, handler)
+	}
+	var logOptions []apachelog.Option
+	layout := cfg.LogTemplate
+	switch cfg.LogFormat {
+	case "", "common":
+	case "combined":
+		if layout == "" {
+			layout = apachelog.CombinedLogFormat
+		}
+	case "json":
+		logOptions = append(logOptions, apachelog.JSON())
+	default:
+		return nil, fmt.Errorf("invalid log format %q: expected common, combined or json", cfg.LogFormat)
+	}
+	logFormat, err := apachelog.Format(layout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log template: %s", err)
+	}
+	logOptions = append(logOptions, logFormat)
+	if cfg.DumpOut != nil {
+		// inside the access log, so both see the same final status
+		handler = dumpHandler(cfg.DumpOut, handler)
+	}
+	if cfg.LogTLS {
+		logOptions = append(logOptions, apachelog.LogTLS())
+	}
+	if cfg.RequestID {
+		logOptions = append(logOptions, apachelog.LogRequestID())
+	}
+	if cfg.LogSNI {
+		logOptions = append(logOptions, apachelog.LogServerName())
+	}
+	if cfg.LogResolve {
+		logOptions = append(logOptions, apachelog.ResolveHosts())
+	}
+	if cfg.LogMicros {
+		logOptions = append(logOptions, apachelog.Microseconds())
+	}
+	if cfg.LogUTC {
+		logOptions = append(logOptions, apachelog.UTC())
+	}
+	if cfg.LogNoQuery {
+		logOptions = append(logOptions, apachelog.NoQuery())
+	}
+	if cfg.LogSample > 1 {
+		logOptions = append(logOptions, apachelog.Sample(cfg.LogSample))
+	}
+	if cfg.SlowThreshold > 0 {
+		logOptions = append(logOptions, apachelog.SlowThreshold(cfg.SlowThreshold))
+	}
+	if len(cfg.LogSkip) > 0 {
+		logOptions = append(logOptions, apachelog.SkipPaths(cfg.LogSkip))
+	}
+	out := cfg.LogOut
+	if out == nil {
+		out = os.Stdout
+	}
+	handler = apachelog.NewHandler(handler, out, logOptions...)
+	if len(cfg.TrustedProxies) > 0 {
+		trusted, err := parseCIDRs(cfg.TrustedProxies)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxies: %s", err)
+		}
+		// outside the access log, so it logs the client rather than the proxy
+		handler = realIPHandler(trusted, handler)
+	}
+	return handler, nil
+}
@@ -0,0 +1,583 @@
+package webserver
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// writeFiles creates each file in files, by slash-separated path, under dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUploadKeepsFileOnFailure(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"keep.txt": "original"})
+	h := maxBodyHandler(10, uploadHandler(root, false, http.NotFoundHandler()))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/keep.txt", strings.NewReader(strings.Repeat("x", 100))))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized PUT: got %d, want 413", w.Code)
+	}
+	if b, err := os.ReadFile(filepath.Join(root, "keep.txt")); err != nil || string(b) != "original" {
+		t.Errorf("after a failed PUT keep.txt holds %q, %v; want it untouched", b, err)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 1 {
+		t.Errorf("temporary file left behind: %d entries in root", len(entries))
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/keep.txt", strings.NewReader("new")))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("PUT: got %d, want 201", w.Code)
+	}
+	if b, _ := os.ReadFile(filepath.Join(root, "keep.txt")); string(b) != "new" {
+		t.Errorf("after a PUT keep.txt holds %q, want %q", b, "new")
+	}
+}
+
+// serve sends r to the handler BuildHandler makes of cfg, returning the
+// response and the access log it wrote.
+func serve(t *testing.T, cfg Config, r *http.Request) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	var log strings.Builder
+	cfg.LogOut = &log
+	h, err := BuildHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w, log.String()
+}
+
+func TestDirectoryListing(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a", "sub/b.txt": "b"})
+	w, _ := serve(t, Config{Root: root}, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, want 200", w.Code)
+	}
+	for _, link := range []string{`href="a.txt"`, `href="sub/"`} {
+		if !strings.Contains(w.Body.String(), link) {
+			t.Errorf("listing lacks %s:\n%s", link, w.Body)
+		}
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	w, _ := serve(t, Config{Root: t.TempDir()}, httptest.NewRequest("GET", "/missing.txt", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d, want 404", w.Code)
+	}
+}
+
+func TestAccessLogLine(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "hello"})
+	r := httptest.NewRequest("GET", "/a.txt", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	_, log := serve(t, Config{Root: root}, r)
+	if !strings.HasPrefix(log, "192.0.2.1:80 - - [") || !strings.Contains(log, `] "GET /a.txt HTTP/1.1" 200 5 `) {
+		t.Errorf("logged %q", log)
+	}
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	writeFiles(t, root, map[string]string{"real.txt": "inside"})
+	writeFiles(t, outside, map[string]string{"secret.txt": "outside"})
+	if err := os.Symlink(filepath.Join(root, "real.txt"), filepath.Join(root, "in.txt")); err != nil {
+		t.Skipf("can't make symlinks: %s", err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "out.txt")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path   string
+		follow bool
+		want   int
+	}{
+		{"/in.txt", false, http.StatusOK},
+		{"/out.txt", false, http.StatusForbidden},
+		{"/in.txt", true, http.StatusOK},
+		{"/out.txt", true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		w, _ := serve(t, Config{Root: root, FollowSymlinks: tt.follow}, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.want {
+			t.Errorf("GET %s with FollowSymlinks %v: got %d, want %d", tt.path, tt.follow, w.Code, tt.want)
+		}
+	}
+}
+
+func TestCompressedETag(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": strings.Repeat("compress me ", 500)})
+	cfg := Config{Root: root, ETag: true, Gzip: true, Brotli: true}
+	get := func(acceptEncoding, ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/a.txt", nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		r.Header.Set("If-None-Match", ifNoneMatch)
+		w, _ := serve(t, cfg, r)
+		return w
+	}
+	identity := get("", "").Header().Get("ETag")
+	gzipped := get("gzip", "").Header().Get("ETag")
+	brotli := get("br", "").Header().Get("ETag")
+	if identity == "" || identity == gzipped || identity == brotli || gzipped == brotli {
+		t.Fatalf("ETags aren't distinct: identity %s, gzip %s, br %s", identity, gzipped, brotli)
+	}
+	if w := get("", gzipped); w.Code != http.StatusOK {
+		t.Errorf("identity request with the gzip ETag: got %d, want 200", w.Code)
+	}
+	if w := get("", identity); w.Code != http.StatusNotModified {
+		t.Errorf("identity request with its own ETag: got %d, want 304", w.Code)
+	}
+}
+
+func TestSingleFile(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"page.html": "<p>hi</p>", "other.txt": "other"})
+	cfg := Config{Root: filepath.Join(root, "page.html")}
+	w, _ := serve(t, cfg, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "<p>hi</p>" {
+		t.Errorf("GET /: got %d %q, want the file", w.Code, w.Body)
+	}
+	for _, path := range []string{"/page.html", "/other.txt", "/x/"} {
+		if w, _ := serve(t, cfg, httptest.NewRequest("GET", path, nil)); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: got %d, want 404", path, w.Code)
+		}
+	}
+}
+
+func TestMIMETypes(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.mdx": "# hi", "a.wasm": "\x00asm"})
+	cfg := Config{Root: root, MIMETypes: map[string]string{".mdx": "text/mdx"}}
+	for path, want := range map[string]string{"/a.mdx": "text/mdx", "/a.wasm": "application/wasm"} {
+		w, _ := serve(t, cfg, httptest.NewRequest("GET", path, nil))
+		if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, want) {
+			t.Errorf("GET %s: Content-Type %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a/index.htm": "htm", "b/home.html": "home", "b/index.html": "html"})
+	tests := []struct {
+		index []string
+		path  string
+		want  string
+	}{
+		{[]string{"index.html", "index.htm"}, "/a/", "htm"},
+		{[]string{"home.html", "index.html"}, "/b/", "home"},
+		{nil, "/b/", "html"},
+	}
+	for _, tt := range tests {
+		w, _ := serve(t, Config{Root: root, Index: tt.index}, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != tt.want {
+			t.Errorf("GET %s with Index %q: got %d %q, want %q", tt.path, tt.index, w.Code, w.Body, tt.want)
+		}
+	}
+}
+
+func TestAllowDeny(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a"})
+	cfg := Config{
+		Root:  root,
+		Allow: []string{"192.0.2.0/24", "2001:db8::/32"},
+		Deny:  []string{"192.0.2.66", "2001:db8:bad::/48"},
+	}
+	tests := []struct {
+		remote string
+		want   int
+	}{
+		{"192.0.2.1:1234", http.StatusOK},
+		{"192.0.2.66:1234", http.StatusForbidden},
+		{"198.51.100.1:1234", http.StatusForbidden},
+		{"[2001:db8::1]:1234", http.StatusOK},
+		{"[2001:db8:bad::1]:1234", http.StatusForbidden},
+		{"[::1]:1234", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/a.txt", nil)
+		r.RemoteAddr = tt.remote
+		if w, _ := serve(t, cfg, r); w.Code != tt.want {
+			t.Errorf("from %s: got %d, want %d", tt.remote, w.Code, tt.want)
+		}
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"small.txt": "12345", "big.txt": strings.Repeat("x", 11)})
+	cfg := Config{Root: root, MaxFileSize: 10}
+	for path, want := range map[string]int{"/small.txt": http.StatusOK, "/big.txt": http.StatusRequestEntityTooLarge} {
+		if w, _ := serve(t, cfg, httptest.NewRequest("GET", path, nil)); w.Code != want {
+			t.Errorf("GET %s: got %d, want %d", path, w.Code, want)
+		}
+	}
+}
+
+func TestGzipIgnoresRange(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": strings.Repeat("compress me ", 500)})
+	r := httptest.NewRequest("GET", "/a.txt", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.Header.Set("Range", "bytes=0-99")
+	w, _ := serve(t, Config{Root: root, Gzip: true}, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("got %d with Content-Encoding %q, want a gzipped 200", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	if got := w.Header().Get("Accept-Ranges"); got != "" {
+		t.Errorf("gzipped response has Accept-Ranges %q", got)
+	}
+	if got := w.Header().Get("Content-Range"); got != "" {
+		t.Errorf("gzipped response has Content-Range %q", got)
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a"})
+	cfg := Config{Root: root, TrustedProxies: []string{"10.0.0.0/8"}}
+	tests := []struct {
+		remote    string
+		forwarded string
+		want      string
+	}{
+		{"10.0.0.1:1234", "192.0.2.1", "192.0.2.1:"},
+		// trusted hops are skipped, and what the client said itself isn't believed
+		{"10.0.0.1:1234", "203.0.113.9, 192.0.2.1, 10.0.0.2", "192.0.2.1:"},
+		{"198.51.100.1:1234", "192.0.2.1", "198.51.100.1:"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/a.txt", nil)
+		r.RemoteAddr = tt.remote
+		r.Header.Set("X-Forwarded-For", tt.forwarded)
+		if _, log := serve(t, cfg, r); !strings.HasPrefix(log, tt.want) {
+			t.Errorf("from %s forwarded for %s: logged %q, want the client %s", tt.remote, tt.forwarded, log, strings.TrimSuffix(tt.want, ":"))
+		}
+	}
+}
+
+func TestBannerFile(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"index.html": "index", "sub/index.html": "sub index", "banner.html": "banner"})
+	cfg := Config{Root: root, BannerFile: filepath.Join(root, "banner.html")}
+	for path, want := range map[string]string{"/": "banner", "/sub/": "sub index"} {
+		w, _ := serve(t, cfg, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("GET %s: got %d %q, want %q", path, w.Code, w.Body, want)
+		}
+	}
+	// under a Prefix, the top of the files is the prefix, not /
+	cfg.Prefix = "/docs"
+	for path, want := range map[string]string{"/docs/": "banner", "/docs/sub/": "sub index"} {
+		w, _ := serve(t, cfg, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("with Prefix, GET %s: got %d %q, want %q", path, w.Code, w.Body, want)
+		}
+	}
+	if w, _ := serve(t, cfg, httptest.NewRequest("GET", "/", nil)); w.Body.String() == "banner" {
+		t.Error("with Prefix, the banner is served at /")
+	}
+}
+
+func TestCharset(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "text", "a.png": "\x89PNG\r\n\x1a\n"})
+	cfg := Config{Root: root, Charset: "utf-8"}
+	for path, want := range map[string]string{"/a.txt": "text/plain; charset=utf-8", "/a.png": "image/png"} {
+		w, _ := serve(t, cfg, httptest.NewRequest("GET", path, nil))
+		if got := w.Header().Get("Content-Type"); got != want {
+			t.Errorf("GET %s: Content-Type %q, want %q", path, got, want)
+		}
+	}
+}
+
+// hijackRecorder is a ResponseRecorder that can be hijacked, as a server's
+// ResponseWriter can.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func TestWritersUnwrap(t *testing.T) {
+	wrappers := map[string]func(http.ResponseWriter) http.ResponseWriter{
+		"serverHeaderWriter": func(w http.ResponseWriter) http.ResponseWriter {
+			return &serverHeaderWriter{ResponseWriter: w}
+		},
+		"charsetWriter": func(w http.ResponseWriter) http.ResponseWriter {
+			return &charsetWriter{ResponseWriter: w}
+		},
+		"errorPageWriter": func(w http.ResponseWriter) http.ResponseWriter {
+			return &errorPageWriter{ResponseWriter: w}
+		},
+		"compressWriter": func(w http.ResponseWriter) http.ResponseWriter {
+			return &compressWriter{ResponseWriter: w}
+		},
+		"statusWriter": func(w http.ResponseWriter) http.ResponseWriter {
+			return &statusWriter{ResponseWriter: w}
+		},
+	}
+	for name, wrap := range wrappers {
+		w := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+		if _, _, err := http.NewResponseController(wrap(w)).Hijack(); err != nil || !w.hijacked {
+			t.Errorf("%s: Hijack didn't reach the ResponseWriter underneath: %v", name, err)
+		}
+	}
+}
+
+func TestFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.html":  {Data: []byte("embedded")},
+		"css/app.css": {Data: []byte("body{}")},
+	}
+	cfg := Config{Root: t.TempDir(), FS: fsys}
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/", http.StatusOK, "embedded"},
+		{"/css/app.css", http.StatusOK, "body{}"},
+		{"/missing.txt", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		w, _ := serve(t, cfg, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.code || tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("GET %s: got %d %q, want %d %q", tt.path, w.Code, w.Body, tt.code, tt.body)
+		}
+	}
+}
+
+func TestProxies(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/found" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "from the backend")
+	}))
+	defer backend.Close()
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a"})
+	cfg := Config{Root: root, Proxies: map[string]string{"/api/": backend.URL}}
+
+	w, log := serve(t, cfg, httptest.NewRequest("GET", "/api/found", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "from the backend" {
+		t.Errorf("GET /api/found: got %d %q", w.Code, w.Body)
+	}
+	if !strings.Contains(log, `"GET /api/found HTTP/1.1" 200 16 `) {
+		t.Errorf("GET /api/found logged %q", log)
+	}
+	if _, log := serve(t, cfg, httptest.NewRequest("GET", "/api/missing", nil)); !strings.Contains(log, `"GET /api/missing HTTP/1.1" 404 `) {
+		t.Errorf("GET /api/missing logged %q, want the backend's 404", log)
+	}
+	if w, _ := serve(t, cfg, httptest.NewRequest("GET", "/a.txt", nil)); w.Body.String() != "a" {
+		t.Errorf("GET /a.txt: got %q from outside the proxied prefix", w.Body)
+	}
+}
+
+func TestCompressMin(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"small.txt": strings.Repeat("s", 99), "big.txt": strings.Repeat("b", 100)})
+	cfg := Config{Root: root, Gzip: true, GzipLevel: 9, CompressMin: 100}
+	for path, want := range map[string]string{"/small.txt": "", "/big.txt": "gzip"} {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w, _ := serve(t, cfg, r)
+		if got := w.Header().Get("Content-Encoding"); got != want {
+			t.Errorf("GET %s: Content-Encoding %q, want %q", path, got, want)
+		}
+	}
+
+	for _, level := range []int{-1, 10} {
+		if _, err := BuildHandler(Config{Root: root, Gzip: true, GzipLevel: level}); err == nil {
+			t.Errorf("GzipLevel %d was accepted", level)
+		}
+	}
+}
+
+func TestLogNoQuery(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a"})
+	for noQuery, want := range map[bool]string{false: `"GET /a.txt?token=secret HTTP/1.1"`, true: `"GET /a.txt HTTP/1.1"`} {
+		_, log := serve(t, Config{Root: root, LogNoQuery: noQuery}, httptest.NewRequest("GET", "/a.txt?token=secret", nil))
+		if !strings.Contains(log, want) {
+			t.Errorf("with LogNoQuery %v: logged %q, want %s", noQuery, log, want)
+		}
+	}
+}
+
+func TestDownloads(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"plain.zip": "z", `a"b.zip`: "z", "résumé.ZIP": "z", "a.txt": "a"})
+	cfg := Config{Root: root, Downloads: []string{"zip"}}
+	for _, name := range []string{"plain.zip", `a"b.zip`, "résumé.ZIP"} {
+		w, _ := serve(t, cfg, httptest.NewRequest("GET", "/"+url.PathEscape(name), nil))
+		disposition, params, err := mime.ParseMediaType(w.Header().Get("Content-Disposition"))
+		if err != nil || disposition != "attachment" || params["filename"] != name {
+			t.Errorf("GET %s: Content-Disposition %q doesn't give the name back", name, w.Header().Get("Content-Disposition"))
+		}
+	}
+	if w, _ := serve(t, cfg, httptest.NewRequest("GET", "/a.txt", nil)); w.Header().Get("Content-Disposition") != "" {
+		t.Errorf("GET /a.txt: Content-Disposition %q", w.Header().Get("Content-Disposition"))
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	for _, p := range []string{"../../etc/passwd", "/../../etc/passwd", "/a/../../etc/passwd", `..\..\etc\passwd`, "/%2e%2e/etc/passwd"} {
+		name, err := safeJoin(root, p)
+		if err == nil && !withinDir(root, name) {
+			t.Errorf("safeJoin(%q) = %s, outside the root", p, name)
+		}
+	}
+	if name, err := safeJoin(root, "/a/b.txt"); err != nil || name != filepath.Join(root, "a", "b.txt") {
+		t.Errorf("safeJoin(/a/b.txt) = %s, %v", name, err)
+	}
+}
+
+func TestUploadSymlinks(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	writeFiles(t, outside, map[string]string{"secret.txt": "secret"})
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Skipf("can't make symlinks: %s", err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret.txt"), filepath.Join(root, "secret.txt")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path   string
+		follow bool
+		want   int
+	}{
+		{"/link/evil.txt", false, http.StatusForbidden},
+		{"/link/sub/evil.txt", false, http.StatusForbidden},
+		{"/secret.txt", false, http.StatusForbidden},
+		{"/../evil.txt", false, http.StatusForbidden},
+		{"/new/ok.txt", false, http.StatusCreated},
+		{"/link/evil.txt", true, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		h := uploadHandler(root, tt.follow, http.NotFoundHandler())
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("PUT", "/", strings.NewReader("evil"))
+		r.URL.Path = tt.path
+		h.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("PUT %s with follow %v: got %d, want %d", tt.path, tt.follow, w.Code, tt.want)
+		}
+		if tt.follow {
+			continue
+		}
+		if entries, _ := os.ReadDir(outside); len(entries) != 1 {
+			t.Errorf("PUT %s wrote outside the root", tt.path)
+		}
+		if b, _ := os.ReadFile(filepath.Join(outside, "secret.txt")); string(b) != "secret" {
+			t.Errorf("PUT %s overwrote the file outside the root", tt.path)
+		}
+	}
+}
+
+func TestTraceRefused(t *testing.T) {
+	tests := []struct {
+		readOnly, upload bool
+		method           string
+		want             string
+	}{
+		{false, false, "TRACE", "GET, HEAD, POST, PUT, DELETE, OPTIONS"},
+		{true, false, "TRACE", "GET, HEAD"},
+		{true, true, "TRACE", "GET, HEAD, PUT"},
+		{true, false, "CONNECT", "GET, HEAD"},
+		{true, false, "DELETE", "GET, HEAD"},
+	}
+	for _, tt := range tests {
+		cfg := Config{Root: t.TempDir(), ReadOnly: tt.readOnly, Upload: tt.upload}
+		w, _ := serve(t, cfg, httptest.NewRequest(tt.method, "/", nil))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s with ReadOnly %v, Upload %v: got %d, want 405", tt.method, tt.readOnly, tt.upload, w.Code)
+		}
+		if allow := w.Header().Get("Allow"); allow != tt.want {
+			t.Errorf("%s with ReadOnly %v, Upload %v: Allow %q, want %q", tt.method, tt.readOnly, tt.upload, allow, tt.want)
+		}
+	}
+}
+
+func TestServerHeader(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "backend/1.0")
+	}))
+	defer backend.Close()
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"a.txt": "a"})
+	tests := []struct {
+		value string
+		path  string
+		want  string
+	}{
+		{"sws", "/a.txt", "sws"},
+		{"sws", "/api/", "sws"},
+		{"-", "/api/", ""},
+		{"", "/api/", "backend/1.0"},
+	}
+	for _, tt := range tests {
+		cfg := Config{Root: root, ServerHeader: tt.value, Proxies: map[string]string{"/api/": backend.URL}}
+		w, _ := serve(t, cfg, httptest.NewRequest("GET", tt.path, nil))
+		if got := w.Header().Get("Server"); got != tt.want {
+			t.Errorf("GET %s with ServerHeader %q: Server %q, want %q", tt.path, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestHead(t *testing.T) {
+	root := t.TempDir()
+	body := strings.Repeat("compress me ", 500)
+	writeFiles(t, root, map[string]string{"a.txt": body})
+	w, log := serve(t, Config{Root: root}, httptest.NewRequest("HEAD", "/a.txt", nil))
+	if got := w.Header().Get("Content-Length"); got != strconv.Itoa(len(body)) {
+		t.Errorf("HEAD: Content-Length %q, want %d", got, len(body))
+	}
+	if w.Body.Len() != 0 || !strings.Contains(log, `"HEAD /a.txt HTTP/1.1" 200 0 `) {
+		t.Errorf("HEAD: sent %d bytes of body and logged %q", w.Body.Len(), log)
+	}
+
+	r := httptest.NewRequest("HEAD", "/a.txt", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w, _ = serve(t, Config{Root: root, Gzip: true}, r)
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Content-Length") != "" || w.Body.Len() != 0 {
+		t.Errorf("gzipped HEAD: Content-Encoding %q, Content-Length %q and %d bytes of body",
+			w.Header().Get("Content-Encoding"), w.Header().Get("Content-Length"), w.Body.Len())
+	}
+}
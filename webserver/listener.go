@@ -0,0 +1,129 @@
+package webserver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// listenUnix listens on a Unix domain socket at path, first removing a stale
+// socket left there by an earlier run. Anything else at path is left alone
+// and reported as an error. The socket file is removed when the listener is
+// closed.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("failed to listen on %s: file exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %s", path, err)
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %s", path, err)
+	}
+	return ln, nil
+}
+
+// listenTCP listens on the TCP address addr, with SO_REUSEPORT set when
+// reusePort is, so several processes can share the port. When backlog > 0
+// the accept queue is set to that length; where that can't be done, a
+// warning is logged and the system's default is kept.
+func listenTCP(addr string, reusePort bool, backlog int) (net.Listener, error) {
+	var lc net.ListenConfig
+	if reusePort {
+		lc.Control = reusePortControl
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err == nil && backlog > 0 {
+		if err := setBacklog(ln, backlog); err != nil {
+			log.Printf("warning: can't set the listen backlog of %s: %s", addr, err)
+		}
+	}
+	return ln, err
+}
+
+// keepAliveListener is a net.Listener that sets the TCP keep-alive period of
+// the connections it accepts, or turns keep-alive off when period < 0. Other
+// connections, such as over Unix sockets, are passed through untouched.
+type keepAliveListener struct {
+	net.Listener
+	period time.Duration
+}
+
+func (l keepAliveListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		if l.period < 0 {
+			tc.SetKeepAlive(false)
+		} else {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(l.period)
+		}
+	}
+	return c, nil
+}
+
+// limitListener is a net.Listener that lets at most cap(sem) connections be
+// served at once. The semaphore may be shared between listeners, so a slot is
+// only taken once a connection has arrived. Accept then blocks until an
+// earlier connection is closed rather than turning the new one away.
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLimitListener(ln net.Listener, sem chan struct{}) *limitListener {
+	return &limitListener{
+		Listener: ln,
+		sem:      sem,
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		c.Close()
+		return nil, net.ErrClosed
+	}
+	return &limitConn{Conn: c, sem: l.sem}, nil
+}
+
+// Close closes the listener and wakes an Accept waiting for a free slot.
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+// limitConn gives back its limitListener slot when it is first closed.
+type limitConn struct {
+	net.Conn
+	sem  chan struct{}
+	once sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		<-c.sem
+	})
+	return err
+}
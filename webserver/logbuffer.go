@@ -0,0 +1,70 @@
+package webserver
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+)
+
+// BufferedWriter collects writes in a buffer and passes them on to the
+// underlying writer when it fills up, at every flush interval and on Close,
+// so a busy access log costs fewer system calls. It is safe for concurrent
+// use. Writes are never split unless they are larger than the buffer.
+type BufferedWriter struct {
+	mu   sync.Mutex
+	buf  *bufio.Writer
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewBufferedWriter returns a BufferedWriter for w with a buffer of size
+// bytes that is flushed every interval.
+func NewBufferedWriter(w io.Writer, size int, interval time.Duration) *BufferedWriter {
+	b := &BufferedWriter{
+		buf:  bufio.NewWriterSize(w, size),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(b.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				b.Flush()
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+	return b
+}
+
+func (b *BufferedWriter) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(p) > b.buf.Available() && b.buf.Buffered() > 0 {
+		// keep each line in one write to the underlying writer
+		if err := b.buf.Flush(); err != nil {
+			return 0, err
+		}
+	}
+	return b.buf.Write(p)
+}
+
+// Flush passes whatever is buffered on to the underlying writer.
+func (b *BufferedWriter) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Flush()
+}
+
+// Close stops the periodic flushing and flushes what is left. The underlying
+// writer is left open.
+func (b *BufferedWriter) Close() error {
+	close(b.stop)
+	<-b.done
+	return b.Flush()
+}
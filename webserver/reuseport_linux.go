@@ -0,0 +1,7 @@
+//go:build 386 || amd64 || arm
+
+package webserver
+
+// soReusePort is SO_REUSEPORT, which syscall leaves out on these
+// architectures although Linux has had it since 3.9.
+const soReusePort = 0xf
@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package webserver
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePortControl would set SO_REUSEPORT, but this platform has no such
+// option, so it always fails.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
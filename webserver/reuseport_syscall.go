@@ -0,0 +1,7 @@
+//go:build (linux && !(386 || amd64 || arm)) || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package webserver
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
@@ -0,0 +1,30 @@
+//go:build !windows && !plan9
+
+package webserver
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"strings"
+)
+
+// SyslogWriter returns a writer that sends each write to syslog as one
+// message, at priority daemon.info and tagged simple_web_server. addr is
+// "local" for the local syslog daemon, or the address of a remote one as
+// udp://host:port, tcp://host:port or just host:port for UDP.
+func SyslogWriter(addr string) (io.WriteCloser, error) {
+	network := ""
+	if addr == "local" {
+		addr = ""
+	} else if i := strings.Index(addr, "://"); i >= 0 {
+		network, addr = addr[:i], addr[i+3:]
+	} else {
+		network = "udp"
+	}
+	w, err := syslog.Dial(network, addr, syslog.LOG_DAEMON|syslog.LOG_INFO, "simple_web_server")
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %s", err)
+	}
+	return w, nil
+}
@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package webserver
+
+import (
+	"errors"
+	"io"
+)
+
+// SyslogWriter would return a writer to syslog, but there is no syslog on this
+// platform, so it always fails.
+func SyslogWriter(addr string) (io.WriteCloser, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,115 @@
+package webserver
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// SelfSignedCert creates a certificate and key for localhost, issued to org
+// and valid for days from now. They are kept in memory only, so nothing is
+// left behind on disk. An empty org means Acme Co and days <= 0 means 365.
+func SelfSignedCert(org string, days int) (cert tls.Certificate, err error) {
+	if org == "" {
+		org = "Acme Co"
+	}
+	if days <= 0 {
+		days = 365
+	}
+	// from http://golang.org/src/pkg/crypto/tls/generate_cert.go
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		return cert, fmt.Errorf("failed to generate private key: %s", err)
+	}
+	// a random serial, so certificates from different runs are told apart
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return cert, fmt.Errorf("failed to generate serial number: %s", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{org},
+		},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(0, 0, days),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{"localhost"},
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return cert, fmt.Errorf("failed to create certificate: %s", err)
+	}
+	cert = tls.Certificate{
+		Certificate: [][]byte{derBytes},
+		PrivateKey:  priv,
+	}
+	return
+}
+
+// loadCert reads a certificate chain and its private key from PEM files.
+func loadCert(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %s", err)
+	}
+	return &cert, nil
+}
+
+// newTLSConfig returns the TLS config for the HTTPS servers, with certificates
+// from Let's Encrypt when acme is set and from getCertificate otherwise. HTTP/2
+// is offered through ALPN unless http2 is false.
+func newTLSConfig(acme *autocert.Manager, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), http2 bool) (config *tls.Config) {
+	if acme != nil {
+		config = acme.TLSConfig()
+	} else {
+		config = &tls.Config{
+			GetCertificate: getCertificate,
+			NextProtos:     []string{"h2", "http/1.1"},
+		}
+	}
+	if !http2 {
+		var protos []string
+		for _, proto := range config.NextProtos {
+			if proto != "h2" {
+				protos = append(protos, proto)
+			}
+		}
+		config.NextProtos = protos
+	}
+	return
+}
+
+// debugTLS makes config log every TLS client hello, with what the client
+// offered, and what each handshake settled on before the client confirmed
+// it. Failed handshakes are already logged by net/http, so together they
+// show where a client gives up.
+func debugTLS(config *tls.Config) {
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		var versions []string
+		for _, v := range hello.SupportedVersions {
+			versions = append(versions, tls.VersionName(v))
+		}
+		log.Printf("tls: hello from %s: server name %q, versions %s, ALPN %s",
+			hello.Conn.RemoteAddr(), hello.ServerName, strings.Join(versions, ","), strings.Join(hello.SupportedProtos, ","))
+		return nil, nil
+	}
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		log.Printf("tls: server name %q settled on %s, %s, ALPN %q",
+			state.ServerName, tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), state.NegotiatedProtocol)
+		return nil
+	}
+}
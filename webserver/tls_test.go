@@ -0,0 +1,88 @@
+package webserver
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSelfSignedCertSerials(t *testing.T) {
+	var serials []string
+	for i := 0; i < 2; i++ {
+		cert, err := SelfSignedCert("", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.SerialNumber.Sign() <= 0 {
+			t.Errorf("serial %s isn't positive", parsed.SerialNumber)
+		}
+		serials = append(serials, parsed.SerialNumber.String())
+	}
+	if serials[0] == serials[1] {
+		t.Errorf("two certificates share the serial %s", serials[0])
+	}
+}
+
+// writeCert writes a self-signed certificate for org and its key to
+// cert.pem and key.pem in dir, replacing any already there.
+func writeCert(t *testing.T, dir, org string) (certFile, keyFile string) {
+	t.Helper()
+	cert, err := SelfSignedCert(org, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(cert.PrivateKey.(*rsa.PrivateKey))})
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestReloadCertFile(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "First Co")
+	cfg := Config{
+		Addrs:    []Addr{{Host: "127.0.0.1", Port: "0", TLS: true}},
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}
+	s := startServer(t, cfg)
+	address := strings.TrimSuffix(strings.TrimPrefix(s.URLs()[0], "https://"), "/")
+	// org returns the organization of the certificate a new handshake gets
+	org := func() string {
+		conn, err := tls.Dial("tcp", address, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.Organization[0]
+	}
+	if got := org(); got != "First Co" {
+		t.Fatalf("before Reload: served %q's certificate", got)
+	}
+
+	writeCert(t, dir, "Second Co")
+	cfg.Root = s.Config.Root
+	cfg.LogOut = io.Discard
+	if err := s.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := org(); got != "Second Co" {
+		t.Errorf("after Reload: served %q's certificate, want the new one", got)
+	}
+}
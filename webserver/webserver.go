@@ -0,0 +1,509 @@
+// Package webserver serves a directory of files over HTTP and HTTPS, with the
+// access logging and middleware of simple_web_server. It is what the
+// simple_web_server command runs, and can be embedded in other programs:
+//
+//	s := &webserver.Server{Config: webserver.Config{
+//		Root:  "./public",
+//		Addrs: []webserver.Addr{{Port: "8080"}},
+//	}}
+//	if err := s.Start(); err != nil {
+//		log.Fatal(err)
+//	}
+//	defer s.Shutdown(context.Background())
+//
+// Files bundled into the program with //go:embed can be served by setting FS
+// in place of Root:
+//
+//	//go:embed public
+//	var public embed.FS
+//
+//	files, _ := fs.Sub(public, "public")
+//	s := &webserver.Server{Config: webserver.Config{FS: files, ...}}
+//
+// To serve the files from an existing server or mux instead, use BuildHandler.
+package webserver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Addr is a host and port to serve on, and whether to serve it over TLS. An
+// empty Host means all interfaces.
+type Addr struct {
+	Host string
+	Port string
+	TLS  bool
+}
+
+func (a Addr) String() string {
+	scheme := "http"
+	if a.TLS {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(a.Host, a.Port)
+}
+
+// Listener is an already bound listener to serve on, such as a socket handed
+// over by systemd, and whether to serve it over TLS.
+type Listener struct {
+	net.Listener
+	TLS bool
+}
+
+// Config is the configuration of a Server. The fields up to OnShutdown shape the
+// handler built by BuildHandler; the rest say where and how it is served.
+type Config struct {
+	Root            string            // directory to serve, or a single file to serve at /
+	FS              fs.FS             // files to serve in place of Root, such as an embed.FS; nil to use Root
+	VHosts          map[string]string // directory to serve instead of Root, by Host
+	Prefix          string            // URL path to serve Root under; "" for /
+	BannerFile      string            // file to serve at / (or Prefix), ahead of any index.html; "" for none
+	Proxies         map[string]string // backend URLs to reverse-proxy requests to, by URL path prefix
+	RootRedirect    string            // path (or URL) to redirect requests for / to with a 302; "" to serve / as usual
+	FollowSymlinks  bool              // serve symlinks that point outside Root
+	SPA             bool              // serve index.html for missing extensionless paths
+	CacheMaxAge     int               // Cache-Control max-age in seconds; 0 to leave it out
+	ETag            bool              // send ETags built from file size and mtime
+	Upload          bool              // store PUT request bodies under Root
+	ReadOnly        bool              // answer 405 to methods other than GET and HEAD, and PUT with Upload
+	Index           []string          // index file names to try in order for directories; nil for index.html
+	ErrorPages      map[int]string    // HTML files to serve as the body of responses, by status code
+	ListingTemplate string            // html/template file to render directory listings with; "" for the default
+	MIMETypes       map[string]string // extra Content-Types by file extension; registered process-wide with mime.AddExtensionType
+	Charset         string            // charset to add to text Content-Types without one; "" to leave them alone
+	CORSOrigins     []string          // origins allowed cross-origin access; "*" for any
+	CSP             string            // Content-Security-Policy header value; "" for none
+	HSTS            string            // Strict-Transport-Security header value for HTTPS; "" for none
+	FrameOptions    string            // X-Frame-Options header value; "" for none
+	ServerHeader    string            // Server header value; "-" to remove any, such as a proxied backend's; "" to leave it be
+	MaxBodyBytes    int64             // largest request body to accept; 0 for no limit
+	MaxFileSize     int64             // largest file to serve, in bytes; 0 for no limit
+	Downloads       []string          // extensions of files to send as attachments, to be saved; "*" for all
+	Precompressed   bool              // serve file.br or file.gz, when present, to clients that accept them
+	Gzip            bool              // gzip responses for clients that accept it
+	GzipLevel       int               // gzip compression level, 1 to 9; 0 for gzip.DefaultCompression
+	Brotli          bool              // prefer br over gzip for clients that accept it
+	CompressMin     int               // smallest response body, in bytes, to gzip or br; 0 to compress them all
+	TrustedProxies  []string          // CIDR ranges or IPs of proxies whose X-Forwarded-For is believed
+	Allow           []string          // CIDR ranges or IPs allowed access; empty for all but Deny
+	Deny            []string          // CIDR ranges or IPs refused access with a 403, even if in Allow
+	RateLimit       float64           // requests per second allowed from each client IP; 0 for no limit
+	Timeout         time.Duration     // answer 503 if a request takes longer; 0 for no limit
+	LogFormat       string            // "common", "combined" or "json"; "" for common
+	LogTemplate     string            // apachelog LogFormat-style layout, in place of LogFormat's; "" for none
+	LogTLS          bool              // log the TLS version and cipher suite
+	RequestID       bool              // give each request an ID and log it
+	LogSNI          bool              // log the server name TLS clients asked for with SNI
+	LogResolve      bool              // log client hostnames, from reverse DNS, in place of their IPs
+	LogSkip         []string          // path prefixes to leave out of the access log
+	LogMicros       bool              // log response times in whole microseconds
+	LogUTC          bool              // log times in UTC rather than local time
+	LogNoQuery      bool              // leave query strings out of logged URIs
+	LogSample       int               // log one in this many successful requests; 0 or 1 to log them all
+	SlowThreshold   time.Duration     // log a warning for requests that take longer; 0 for none
+	DumpOut         io.Writer         // where to dump each request's headers and response status; nil for nowhere
+	LogOut          io.Writer         // where the access log goes; nil for os.Stdout
+	PProf           bool              // serve net/http/pprof under /debug/pprof/, ahead of the files
+	ShutdownToken   string            // secret a POST to ShutdownPath must carry to call OnShutdown; "" for none
+	OnShutdown      func()            // called, once the response is written, when a shutdown is requested
+
+	Addrs          []Addr        // addresses to bind and serve on
+	Listeners      []Listener    // bound listeners to serve on as well as Addrs
+	UnixSocket     string        // path of a Unix domain socket to serve plain HTTP on as well; "" for none
+	MaxConns       int           // most connections served at once across all listeners; 0 for no limit
+	MaxHeaderBytes int           // largest request header to accept; 0 for http.DefaultMaxHeaderBytes
+	HeaderTimeout  time.Duration // longest to wait for a TLS handshake and request header; 0 for DefaultHeaderTimeout
+	IdleTimeout    time.Duration // longest to keep an idle keep-alive connection open; 0 for DefaultIdleTimeout
+	KeepAlive      time.Duration // TCP keep-alive period of accepted connections; 0 for Go's default, < 0 to turn it off
+	AutoPort       int           // further ports to try, counting up, when one of Addrs is in use; 0 to fail
+	ReusePort      bool          // bind Addrs with SO_REUSEPORT so other processes can share them; Linux and BSDs only
+	ListenBacklog  int           // accept queue length of the sockets bound for Addrs; 0 for the system's default
+	NoHTTP2        bool          // only speak HTTP/1.1 over TLS
+	DebugTLS       bool          // log each TLS client hello and completed handshake
+	CertFile       string        // PEM certificate (chain) to serve HTTPS with, read again on Reload; "" for a self-signed one
+	KeyFile        string        // PEM private key of CertFile
+	CertOrg        string        // organization of the self-signed certificate; "" for Acme Co
+	CertDays       int           // days the self-signed certificate is valid for; 0 for 365
+	ACMEDomains    []string      // get certificates for these domains from Let's Encrypt
+	ACMECache      string        // directory to keep Let's Encrypt certificates in; "" for acme-cache
+	PProfAddr      string        // address to serve net/http/pprof on by itself, unlogged; "" for none
+	Health         bool          // answer HealthPath, unlogged, with 503 until every listener is serving and 200 after
+}
+
+// DefaultHeaderTimeout and DefaultIdleTimeout bound how long a connection
+// that sends nothing is kept open, so idle or slow clients can't hold on to
+// a MaxConns slot, or a file descriptor, for ever.
+const (
+	DefaultHeaderTimeout = 30 * time.Second
+	DefaultIdleTimeout   = 2 * time.Minute
+)
+
+// ErrPortInUse is returned, wrapped, by Start when a port is taken by another
+// socket.
+var ErrPortInUse = errors.New("already in use")
+
+// Server serves the files described by Config on its addresses and listeners.
+// Set Config, then call Start.
+type Server struct {
+	Config Config
+
+	mu       sync.Mutex // held by Reload
+	handler  atomic.Pointer[http.Handler]
+	cert     atomic.Pointer[tls.Certificate]
+	servers  []*http.Server
+	urls     []string
+	inFlight int64
+	ready    atomic.Bool
+	wg       sync.WaitGroup
+}
+
+// Start binds Config.Addrs, in order, Config.UnixSocket and Config.PProfAddr,
+// and starts serving them and Config.Listeners in the background. If an address can't be
+// bound, the listeners bound so far are closed and the error returned. If the self-signed
+// certificate can't be made, HTTPS is left out with a warning, as long as there's plain HTTP
+// to serve.
+func (s *Server) Start() error {
+	current, err := BuildHandler(s.Config)
+	if err != nil {
+		return err
+	}
+	s.handler.Store(&current)
+	// look the handler up per request, so Reload can swap it
+	handler := inFlightHandler(&s.inFlight, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		(*s.handler.Load()).ServeHTTP(w, r)
+	}))
+	if s.Config.Health {
+		handler = healthHandler(&s.ready, handler)
+	}
+
+	// With Let's Encrypt, the HTTP servers also have to answer the ACME
+	// HTTP-01 challenges
+	var acmeManager *autocert.Manager
+	httpHandler := handler
+	if len(s.Config.ACMEDomains) > 0 {
+		cache := s.Config.ACMECache
+		if cache == "" {
+			cache = "acme-cache"
+		}
+		acmeManager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(s.Config.ACMEDomains...),
+			Cache:      autocert.DirCache(cache),
+		}
+		httpHandler = acmeManager.HTTPHandler(handler)
+	}
+	// Without a certificate there's no HTTPS, but whatever plain HTTP there is
+	// can still be served
+	skipTLS := false
+	if acmeManager == nil && s.serves(true) && s.Config.CertFile != "" {
+		cert, err := loadCert(s.Config.CertFile, s.Config.KeyFile)
+		if err != nil {
+			return err
+		}
+		s.cert.Store(cert)
+	} else if acmeManager == nil && s.serves(true) {
+		cert, err := SelfSignedCert(s.Config.CertOrg, s.Config.CertDays)
+		if err != nil {
+			if !s.serves(false) {
+				return err
+			}
+			log.Printf("warning: not serving HTTPS: %s", err)
+			skipTLS = true
+		} else {
+			s.cert.Store(&cert)
+		}
+	}
+	tlsConfig := newTLSConfig(acmeManager, s.getCertificate, !s.Config.NoHTTP2)
+	if s.Config.DebugTLS {
+		debugTLS(tlsConfig)
+	}
+
+	var listeners []Listener
+	for _, l := range s.Config.Listeners {
+		if l.TLS && skipTLS {
+			l.Close()
+			continue
+		}
+		listeners = append(listeners, l)
+	}
+	inherited := len(listeners)
+	// closeBound closes the listeners Start bound itself, when it fails
+	// part of the way through
+	closeBound := func() {
+		for _, l := range listeners[inherited:] {
+			l.Close()
+		}
+	}
+	for _, addr := range s.Config.Addrs {
+		if addr.TLS && skipTLS {
+			continue
+		}
+		ln, err := listenTCP(net.JoinHostPort(addr.Host, addr.Port), s.Config.ReusePort, s.Config.ListenBacklog)
+		if port, perr := strconv.Atoi(addr.Port); perr == nil && port > 0 {
+			for tries := 0; isAddrInUse(err) && tries < s.Config.AutoPort && port < 65535; tries++ {
+				port++
+				ln, err = listenTCP(net.JoinHostPort(addr.Host, strconv.Itoa(port)), s.Config.ReusePort, s.Config.ListenBacklog)
+				if err == nil {
+					log.Printf("port %s is in use; listening on %d instead", addr.Port, port)
+				}
+			}
+		}
+		if isAddrInUse(err) {
+			closeBound()
+			return fmt.Errorf("port %s is %w; is another server running?", addr.Port, ErrPortInUse)
+		}
+		if err != nil {
+			closeBound()
+			return fmt.Errorf("failed to listen on port %s: %s", addr.Port, err)
+		}
+		listeners = append(listeners, Listener{Listener: ln, TLS: addr.TLS})
+	}
+	if s.Config.UnixSocket != "" {
+		ln, err := listenUnix(s.Config.UnixSocket)
+		if err != nil {
+			closeBound()
+			return err
+		}
+		listeners = append(listeners, Listener{Listener: ln})
+	}
+	var pprofListener net.Listener
+	if s.Config.PProfAddr != "" {
+		pprofListener, err = net.Listen("tcp", s.Config.PProfAddr)
+		if err != nil {
+			closeBound()
+			return fmt.Errorf("failed to listen on %s for pprof: %s", s.Config.PProfAddr, err)
+		}
+	}
+
+	headerTimeout := s.Config.HeaderTimeout
+	if headerTimeout <= 0 {
+		headerTimeout = DefaultHeaderTimeout
+	}
+	idleTimeout := s.Config.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+	connSem := make(chan struct{}, s.Config.MaxConns)
+	for _, l := range listeners {
+		if _, ok := l.Listener.(*net.UnixListener); !ok {
+			s.urls = append(s.urls, localURL(l.Listener, l.TLS))
+		}
+		var ln net.Listener = l.Listener
+		if s.Config.KeepAlive != 0 {
+			ln = keepAliveListener{Listener: ln, period: s.Config.KeepAlive}
+		}
+		if s.Config.MaxConns > 0 {
+			ln = newLimitListener(ln, connSem)
+		}
+		server := &http.Server{
+			Handler:           httpHandler,
+			MaxHeaderBytes:    s.Config.MaxHeaderBytes,
+			ReadHeaderTimeout: headerTimeout,
+			IdleTimeout:       idleTimeout,
+		}
+		if l.TLS {
+			server.Handler = handler
+			server.TLSConfig = tlsConfig
+			if s.Config.NoHTTP2 {
+				// a non-nil, empty map keeps net/http from setting up HTTP/2
+				server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+			}
+		}
+		s.servers = append(s.servers, server)
+		s.wg.Add(1)
+		go func(useTLS bool) {
+			defer s.wg.Done()
+			if useTLS {
+				server.ServeTLS(ln, "", "")
+			} else {
+				server.Serve(ln)
+			}
+		}(l.TLS)
+	}
+	if pprofListener != nil {
+		mux := http.NewServeMux()
+		handlePProf(mux)
+		server := &http.Server{Handler: mux, ReadHeaderTimeout: headerTimeout, IdleTimeout: idleTimeout}
+		s.servers = append(s.servers, server)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			server.Serve(pprofListener)
+		}()
+	}
+	s.ready.Store(true)
+	return nil
+}
+
+// serves reports whether the config has anything to serve with TLS, when
+// useTLS is set, or without it. The Unix socket is always plain HTTP.
+func (s *Server) serves(useTLS bool) bool {
+	if s.Config.UnixSocket != "" && !useTLS {
+		return true
+	}
+	for _, addr := range s.Config.Addrs {
+		if addr.TLS == useTLS {
+			return true
+		}
+	}
+	for _, l := range s.Config.Listeners {
+		if l.TLS == useTLS {
+			return true
+		}
+	}
+	return false
+}
+
+// getCertificate returns the current certificate, from CertFile or self-signed.
+func (s *Server) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.cert.Load(), nil
+}
+
+// Reload applies cfg to a started server without dropping connections: new
+// requests are served by a handler built from cfg, while requests in flight
+// finish with the old one. CertFile and KeyFile are read again, so renewed
+// certificates are picked up, with new handshakes getting the new one, or a
+// new self-signed certificate is made if CertOrg or CertDays changed. The
+// fields from Addrs on that set up the listeners only take effect on a
+// restart, apart from the certificate ones, and are left as they were. On
+// error, nothing changes.
+func (s *Server) Reload(cfg Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	handler, err := BuildHandler(cfg)
+	if err != nil {
+		return err
+	}
+	var cert *tls.Certificate
+	if s.cert.Load() != nil && cfg.CertFile != "" {
+		cert, err = loadCert(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return err
+		}
+		log.Printf("reloaded certificate from %s", cfg.CertFile)
+	} else if s.cert.Load() != nil && (s.Config.CertFile != "" || cfg.CertOrg != s.Config.CertOrg || cfg.CertDays != s.Config.CertDays) {
+		c, err := SelfSignedCert(cfg.CertOrg, cfg.CertDays)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+	s.handler.Store(&handler)
+	if cert != nil {
+		s.cert.Store(cert)
+	}
+	old := s.Config
+	s.Config = cfg
+	s.Config.Addrs = old.Addrs
+	s.Config.Listeners = old.Listeners
+	s.Config.UnixSocket = old.UnixSocket
+	s.Config.MaxConns = old.MaxConns
+	s.Config.MaxHeaderBytes = old.MaxHeaderBytes
+	s.Config.HeaderTimeout = old.HeaderTimeout
+	s.Config.IdleTimeout = old.IdleTimeout
+	s.Config.KeepAlive = old.KeepAlive
+	s.Config.ReusePort = old.ReusePort
+	s.Config.ListenBacklog = old.ListenBacklog
+	s.Config.AutoPort = old.AutoPort
+	s.Config.NoHTTP2 = old.NoHTTP2
+	s.Config.DebugTLS = old.DebugTLS
+	s.Config.ACMEDomains = old.ACMEDomains
+	s.Config.ACMECache = old.ACMECache
+	s.Config.PProfAddr = old.PProfAddr
+	s.Config.Health = old.Health
+	return nil
+}
+
+// URLs returns a URL for reaching each TCP listener from this machine, in the
+// order they are served: Config.Listeners, then Config.Addrs.
+func (s *Server) URLs() []string {
+	return s.urls
+}
+
+// InFlight returns the number of requests currently being served.
+func (s *Server) InFlight() int64 {
+	return atomic.LoadInt64(&s.inFlight)
+}
+
+// Wait blocks until every listener has stopped serving. Requests in flight when
+// Shutdown was called may still be finishing.
+func (s *Server) Wait() {
+	s.wg.Wait()
+}
+
+// Shutdown stops the server gracefully, letting in-flight requests finish until
+// ctx is done and then closing any connections that remain. From the start,
+// HealthPath answers 503 on connections still open.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.ready.Store(false)
+	wg := sync.WaitGroup{}
+	var timedOut sync.Once
+	var err error
+	for _, server := range s.servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if server.Shutdown(ctx) != nil {
+				timedOut.Do(func() {
+					err = fmt.Errorf("shutdown timed out with %d requests in flight; closing their connections",
+						s.InFlight())
+				})
+				server.Close()
+			}
+		}(server)
+	}
+	wg.Wait()
+	return err
+}
+
+// localURL returns the URL for reaching ln from this machine.
+func localURL(ln net.Listener, useTLS bool) string {
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return Addr{Host: host, Port: port, TLS: useTLS}.String() + "/"
+}
+
+// HealthPath is where readiness is reported when Config.Health is set.
+const HealthPath = "/healthz"
+
+// healthHandler answers requests for HealthPath with 200 OK once *ready is
+// set, and 503 Service Unavailable before then. Other requests go to next.
+func healthHandler(ready *atomic.Bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != HealthPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !ready.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, "ok", http.StatusOK)
+	})
+}
+
+// inFlightHandler keeps count of the requests currently being served in
+// *count.
+func inFlightHandler(count *int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(count, 1)
+		defer atomic.AddInt64(count, -1)
+		next.ServeHTTP(w, r)
+	})
+}
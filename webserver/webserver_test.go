@@ -0,0 +1,324 @@
+package webserver
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startServer starts a Server for cfg, serving t.TempDir() unless cfg.Root is
+// set, and shuts it down when the test ends.
+func startServer(t *testing.T, cfg Config) *Server {
+	t.Helper()
+	if cfg.Root == "" {
+		cfg.Root = t.TempDir()
+	}
+	if cfg.LogOut == nil {
+		cfg.LogOut = io.Discard
+	}
+	s := &Server{Config: cfg}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	return s
+}
+
+// insecureClient is an HTTP client that accepts the self-signed certificate.
+func insecureClient() *http.Client {
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		},
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	for _, noHTTP2 := range []bool{false, true} {
+		s := startServer(t, Config{
+			Addrs:   []Addr{{Host: "127.0.0.1", Port: "0", TLS: true}},
+			NoHTTP2: noHTTP2,
+		})
+		resp, err := insecureClient().Get(s.URLs()[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		want := "HTTP/2.0"
+		if noHTTP2 {
+			want = "HTTP/1.1"
+		}
+		if resp.Proto != want {
+			t.Errorf("with NoHTTP2 %v, got %s, want %s", noHTTP2, resp.Proto, want)
+		}
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	s := startServer(t, Config{
+		Addrs:         []Addr{{Host: "127.0.0.1", Port: "0"}},
+		MaxConns:      1,
+		HeaderTimeout: 500 * time.Millisecond,
+	})
+	addr := strings.TrimPrefix(strings.TrimSuffix(s.URLs()[0], "/"), "http://")
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	// give the server time to accept the idle connection and take the slot
+	time.Sleep(100 * time.Millisecond)
+
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		resp, err := insecureClient().Get(s.URLs()[0])
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("second connection was served while the first held the only slot (err %v)", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	// the idle connection is dropped once HeaderTimeout passes, freeing the slot
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+		if waited := time.Since(start); waited < 300*time.Millisecond {
+			t.Errorf("second connection waited only %s", waited)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("second connection was never served")
+	}
+}
+
+func TestCertFailureKeepsHTTP(t *testing.T) {
+	// no x509 certificate can last until the year three million or so
+	const badDays = 1 << 30
+	if _, err := SelfSignedCert("", badDays); err == nil {
+		t.Fatal("SelfSignedCert made a certificate valid for 2^30 days")
+	}
+	s := startServer(t, Config{
+		Addrs: []Addr{
+			{Host: "127.0.0.1", Port: "0"},
+			{Host: "127.0.0.1", Port: "0", TLS: true},
+		},
+		CertDays: badDays,
+	})
+	urls := s.URLs()
+	if len(urls) != 1 || !strings.HasPrefix(urls[0], "http://") {
+		t.Fatalf("got URLs %q, want just the HTTP one", urls)
+	}
+	resp, err := insecureClient().Get(urls[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// with nothing but HTTPS, there's nothing left to serve
+	s = &Server{Config: Config{
+		Root:     t.TempDir(),
+		Addrs:    []Addr{{Host: "127.0.0.1", Port: "0", TLS: true}},
+		CertDays: badDays,
+	}}
+	if err := s.Start(); err == nil {
+		s.Shutdown(context.Background())
+		t.Error("Start succeeded with only HTTPS and no certificate")
+	}
+}
+
+func TestProxyUpgrade(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		line, _ := brw.ReadString('\n')
+		brw.WriteString(line)
+		brw.Flush()
+	}))
+	defer backend.Close()
+	s := startServer(t, Config{
+		Addrs:        []Addr{{Host: "127.0.0.1", Port: "0"}},
+		Proxies:      map[string]string{"/ws/": backend.URL},
+		Charset:      "utf-8",
+		ServerHeader: "sws",
+		Gzip:         true,
+	})
+
+	conn, err := net.Dial("tcp", strings.TrimSuffix(strings.TrimPrefix(s.URLs()[0], "http://"), "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET /ws/ HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got %s, want 101", resp.Status)
+	}
+	io.WriteString(conn, "ping\n")
+	if line, _ := br.ReadString('\n'); line != "ping\n" {
+		t.Errorf("echoed %q over the upgraded connection", line)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	var ready atomic.Bool
+	h := healthHandler(&ready, http.NotFoundHandler())
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+	if code := get(HealthPath); code != http.StatusServiceUnavailable {
+		t.Errorf("before ready: got %d, want 503", code)
+	}
+	ready.Store(true)
+	if code := get(HealthPath); code != http.StatusOK {
+		t.Errorf("once ready: got %d, want 200", code)
+	}
+	if code := get("/other"); code != http.StatusNotFound {
+		t.Errorf("other paths: got %d, want next's 404", code)
+	}
+
+	s := startServer(t, Config{Addrs: []Addr{{Host: "127.0.0.1", Port: "0"}}, Health: true})
+	resp, err := insecureClient().Get(s.URLs()[0] + strings.TrimPrefix(HealthPath, "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("started server: got %s, want 200", resp.Status)
+	}
+}
+
+func TestPortInUse(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	_, port, _ := net.SplitHostPort(taken.Addr().String())
+
+	s := &Server{Config: Config{Root: t.TempDir(), LogOut: io.Discard, Addrs: []Addr{{Host: "127.0.0.1", Port: port}}}}
+	if err := s.Start(); !errors.Is(err, ErrPortInUse) {
+		if err == nil {
+			s.Shutdown(context.Background())
+		}
+		t.Fatalf("Start on a taken port: got %v, want ErrPortInUse", err)
+	}
+
+	s = startServer(t, Config{Addrs: []Addr{{Host: "127.0.0.1", Port: port}}, AutoPort: 10})
+	if got := s.URLs()[0]; strings.Contains(got, ":"+port+"/") {
+		t.Errorf("with AutoPort, got %s, on the taken port", got)
+	}
+}
+
+func TestHTTPOnlyMakesNoCert(t *testing.T) {
+	s := startServer(t, Config{Addrs: []Addr{{Host: "127.0.0.1", Port: "0"}}})
+	if s.cert.Load() != nil {
+		t.Error("a certificate was made for a server without HTTPS")
+	}
+	cfg := s.Config
+	cfg.CertOrg = "Other Co"
+	if err := s.Reload(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if s.cert.Load() != nil {
+		t.Error("Reload made a certificate for a server without HTTPS")
+	}
+}
+
+func TestStreamingThroughWrappers(t *testing.T) {
+	next := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "first\n")
+		w.(http.Flusher).Flush()
+		<-next
+		io.WriteString(w, "second\n")
+	}))
+	defer backend.Close()
+	defer close(next)
+	s := startServer(t, Config{
+		Addrs:        []Addr{{Host: "127.0.0.1", Port: "0"}},
+		Proxies:      map[string]string{"/stream/": backend.URL},
+		Charset:      "utf-8",
+		ServerHeader: "sws",
+		Gzip:         true,
+		CompressMin:  1024,
+		ErrorPages:   map[int]string{},
+	})
+
+	for _, encoding := range []string{"", "gzip"} {
+		req, err := http.NewRequest("GET", s.URLs()[0]+"stream/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoding != "" {
+			req.Header.Set("Accept-Encoding", encoding)
+		}
+		resp, err := insecureClient().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body io.Reader = resp.Body
+		if resp.Header.Get("Content-Encoding") == "gzip" {
+			if body, err = gzip.NewReader(resp.Body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		br := bufio.NewReader(body)
+		// the backend holds back the second chunk until the first arrives, so
+		// this only returns if every wrapper passed the flush on
+		done := make(chan string)
+		go func() {
+			line, _ := br.ReadString('\n')
+			done <- line
+		}()
+		select {
+		case line := <-done:
+			if line != "first\n" {
+				t.Errorf("Accept-Encoding %q: got first chunk %q", encoding, line)
+			}
+		case <-time.After(5 * time.Second):
+			resp.Body.Close()
+			t.Fatalf("Accept-Encoding %q: the first chunk wasn't flushed to the client", encoding)
+		}
+		next <- struct{}{}
+		if line, _ := br.ReadString('\n'); line != "second\n" {
+			t.Errorf("Accept-Encoding %q: got second chunk %q", encoding, line)
+		}
+		resp.Body.Close()
+	}
+}